@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 
 	"github.com/Struki84/GoMemGPT/memory"
@@ -11,43 +12,279 @@ import (
 )
 
 type Agent struct {
-	processor *memory.LLMProcessor
-	ready     *sync.WaitGroup
+	processor     *memory.LLMProcessor
+	memory        *memory.MemoryContext
+	ready         *sync.WaitGroup
+	notifications chan string
 }
 
-func NewAgent(ctx context.Context, llm llms.Model, storage memory.MemoryStorage) Agent {
+// notifications kept until they are read, later ones are dropped
+const maxNotifications = 10
+
+type agentOptions struct {
+	context   []memory.ContextOption
+	processor []memory.ProcessorOption
+}
+
+type AgentOption func(*agentOptions)
+
+func WithContextOptions(opts ...memory.ContextOption) AgentOption {
+	return func(options *agentOptions) {
+		options.context = append(options.context, opts...)
+	}
+}
+
+// WithSystemOptions configures the prompt templates and persona of the agent.
+func WithSystemOptions(opts ...memory.SystemOption) AgentOption {
+	return func(options *agentOptions) {
+		options.processor = append(options.processor, memory.WithSystemOptions(opts...))
+	}
+}
+
+func WithProcessorOptions(opts ...memory.ProcessorOption) AgentOption {
+	return func(options *agentOptions) {
+		options.processor = append(options.processor, opts...)
+	}
+}
+
+func NewAgent(ctx context.Context, llm llms.Model, storage memory.MemoryStorage, opts ...AgentOption) (Agent, error) {
+	options := &agentOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
-	mainContext := memory.NewMemoryContext(storage)
-	proc := memory.NewLLMProcessor(llm, mainContext)
+	notifications := make(chan string, maxNotifications)
+	notify := memory.WithNotifications(func(msg llms.MessageContent) {
+		// the processor doesn't wait for the reader
+		select {
+		case notifications <- msg.Parts[0].(llms.TextContent).String():
+		default:
+			log.Printf("Dropped agent notification, %d are unread", maxNotifications)
+		}
+	})
+
+	mainContext := memory.NewMemoryContext(storage, options.context...)
+	proc, err := memory.NewLLMProcessor(llm, mainContext, append(options.processor, notify)...)
+	if err != nil {
+		return Agent{}, err
+	}
 
 	go proc.Run(ctx, wg)
 
 	return Agent{
-		processor: proc,
-		ready:     wg,
-	}
+		processor:     proc,
+		memory:        mainContext,
+		ready:         wg,
+		notifications: notifications,
+	}, nil
 }
 
-func (agent *Agent) Call(input string, output func(string)) {
+// Call sends the user's message to the agent, output is called with each
+// reply and the returned channel is closed once the agent is done with the
+// message. The agent doesn't always reply.
+func (agent *Agent) Call(input string, output func(string)) <-chan struct{} {
 	agent.ready.Wait()
 
-	agent.processor.Output(func(msg llms.MessageContent) {
+	userMsg := llms.TextParts(llms.ChatMessageTypeHuman, input)
+
+	done := make(chan struct{})
+	agent.processor.Call(userMsg, func(msg llms.MessageContent) {
 		output(msg.Parts[0].(llms.TextContent).String())
+	}, func() {
+		close(done)
 	})
 
-	// log.Printf("Calling agent with input: %s", input)
-	fmt.Println("<<<< Internal Messages >>>>")
+	return done
+}
 
-	userMsg := llms.TextParts(llms.ChatMessageTypeHuman, input)
+// Notifications receives what the agent says on its own, e.g. when a
+// reminder or an event woke it, outside of the replies to Call.
+func (agent *Agent) Notifications() <-chan string {
+	return agent.notifications
+}
 
-	err := agent.processor.System.AppendMessage(userMsg)
-	if err != nil {
-		log.Printf("Error appending user message: %v", err)
+// Pin keeps the most recent message containing the text in
+// short term memory, e.g. the user's initial task description.
+func (agent *Agent) Pin(text string) error {
+	var err error
+	agent.processor.Do(func(ctx context.Context) {
+		err = agent.processor.Operator().Pin(text)
+	})
+
+	return err
+}
+
+func (agent *Agent) Unpin(text string) error {
+	var err error
+	agent.processor.Do(func(ctx context.Context) {
+		err = agent.processor.Operator().Unpin(text)
+	})
+
+	return err
+}
+
+// Schedule wakes the agent with the note on a cron schedule,
+// e.g. "0 9 * * *" or "@every 1h".
+func (agent *Agent) Schedule(spec string, note string) error {
+	return agent.processor.Scheduler.Schedule(spec, note)
+}
+
+// Emit sends a structured non-chat event to the agent, its
+// replies arrive on Notifications.
+func (agent *Agent) Emit(event memory.Event) error {
+	agent.ready.Wait()
+
+	return agent.processor.Emit(event)
+}
+
+// RegisterEvent defines the prompt template for an application event type,
+// the template is compiled right away and returns its parse errors.
+func (agent *Agent) RegisterEvent(eventType string, template string) error {
+	return agent.processor.System.RegisterEvent(eventType, template)
+}
+
+// Usage totals the tokens used by the agent and estimates their cost,
+// the current session is totaled by default.
+func (agent *Agent) Usage(query memory.UsageQuery) (memory.UsageReport, error) {
+	return agent.processor.Usage(query)
+}
+
+// QueuedMessage is a message in the agent's short term memory.
+type QueuedMessage struct {
+	Role   llms.ChatMessageType
+	Text   string
+	Tokens int
+	Pinned bool
+}
+
+// WorkingContext returns the facts the agent keeps in its context.
+func (agent *Agent) WorkingContext() string {
+	workingContext := ""
+	agent.processor.Do(func(ctx context.Context) {
+		workingContext = agent.memory.WorkingContext
+	})
+
+	return workingContext
+}
+
+// Messages lists the short term message queue with the tokens of each message.
+func (agent *Agent) Messages() []QueuedMessage {
+	var msgs []QueuedMessage
+	agent.processor.Do(func(ctx context.Context) {
+		msgs = agent.queuedMessages()
+	})
+
+	return msgs
+}
+
+func (agent *Agent) queuedMessages() []QueuedMessage {
+	msgs := []QueuedMessage{}
+	for _, msg := range agent.memory.Queue() {
+		msgs = append(msgs, QueuedMessage{
+			Role:   msg.Role,
+			Text:   messageText(msg),
+			Tokens: agent.memory.MessageTokens(msg),
+			Pinned: agent.memory.IsPinned(msg),
+		})
+	}
+
+	return msgs
+}
+
+// Snapshot is the agent's memory at one point between two messages.
+type Snapshot struct {
+	WorkingContext string
+	Messages       []QueuedMessage
+	Stats          memory.MemoryStats
+}
+
+// Snapshot reads the working context, message queue and stats at once.
+func (agent *Agent) Snapshot() Snapshot {
+	var snapshot Snapshot
+	agent.processor.Do(func(ctx context.Context) {
+		snapshot = Snapshot{
+			WorkingContext: agent.memory.WorkingContext,
+			Messages:       agent.queuedMessages(),
+			Stats:          agent.memory.Stats(),
+		}
+	})
+
+	return snapshot
+}
+
+// Stats returns the memory stats shown to the model in the primer.
+func (agent *Agent) Stats() memory.MemoryStats {
+	var stats memory.MemoryStats
+	agent.processor.Do(func(ctx context.Context) {
+		stats = agent.memory.Stats()
+	})
+
+	return stats
+}
+
+// Search searches the archival memory the same way the model does.
+func (agent *Agent) Search(query string, page int) (string, error) {
+	var result string
+	var err error
+
+	agent.processor.Do(func(ctx context.Context) {
+		result, err = agent.processor.Operator().ArchivalSearch(ctx, query, page)
+	})
+
+	return result, err
+}
+
+// SearchHistory searches the conversation history, without
+// recalling the messages into the agent's context.
+func (agent *Agent) SearchHistory(query memory.RecallQuery) (memory.RecallResult, error) {
+	var result memory.RecallResult
+	var err error
+
+	agent.processor.Do(func(ctx context.Context) {
+		result, err = agent.memory.Storage.RecallMessages(query)
+	})
+
+	return result, err
+}
+
+// Memorize moves messages from short term to long term memory
+// with the eviction policy, as if the message queue was full.
+func (agent *Agent) Memorize() error {
+	var err error
+	agent.processor.Do(func(ctx context.Context) {
+		err = agent.processor.Operator().Memorize(ctx)
+	})
+
+	return err
+}
+
+// Reset clears the short term memory, the messages are kept in
+// long term memory and the working context is left as is.
+func (agent *Agent) Reset() error {
+	var err error
+	agent.processor.Do(func(ctx context.Context) {
+		err = agent.processor.Operator().Reset()
+	})
+
+	return err
+}
+
+// messageText joins the text parts with the function calls and responses
+func messageText(msg llms.MessageContent) string {
+	parts := []string{}
+	for _, part := range msg.Parts {
+		switch part := part.(type) {
+		case llms.TextContent:
+			parts = append(parts, part.Text)
+		case llms.ToolCall:
+			parts = append(parts, fmt.Sprintf("%s(%s)", part.FunctionCall.Name, part.FunctionCall.Arguments))
+		case llms.ToolCallResponse:
+			parts = append(parts, fmt.Sprintf("%s: %s", part.Name, part.Content))
+		}
 	}
 
-	agent.processor.Input(userMsg)
-	agent.processor.CheckMemoryPressure()
+	return strings.Join(parts, " ")
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/storage"
+)
+
+const commandsHelp = `Commands:
+  /context          show the working context
+  /messages         show the short term messages with their tokens
+  /search <query>   search archival memory and the conversation history
+  /memorize         move messages to long term memory
+  /reset            clear short term memory, messages stay in long term memory
+  /sessions         list the sessions
+  /switch <id>      continue another session, or start a new one
+  /export [path]    write the session's memory to a JSON file
+  /stats            show the memory stats and token usage
+  /debug on|off     log every message the agent handles
+  exit              quit`
+
+// commands runs the REPL's slash commands on the current agent
+type commands struct {
+	ctx context.Context
+	out io.Writer
+
+	agent   Agent
+	storage storage.SqliteStorage
+	stop    context.CancelFunc
+
+	// starts an agent on a session for /switch
+	newAgent func(ctx context.Context, sessionStorage storage.SqliteStorage, opts ...AgentOption) (Agent, error)
+
+	// /debug off restores the configured level, or info
+	logLevel *slog.LevelVar
+	level    slog.Level
+}
+
+func newCommands(ctx context.Context, sessionStorage storage.SqliteStorage, logLevel *slog.LevelVar, newAgent func(context.Context, storage.SqliteStorage, ...AgentOption) (Agent, error)) (*commands, error) {
+	cmds := &commands{
+		ctx:      ctx,
+		out:      os.Stdout,
+		newAgent: newAgent,
+		logLevel: logLevel,
+		level:    max(logLevel.Level(), slog.LevelInfo),
+	}
+
+	err := cmds.start(sessionStorage)
+	if err != nil {
+		return nil, err
+	}
+
+	return cmds, nil
+}
+
+// start runs an agent on the session, the previous agent is stopped
+func (cmds *commands) start(sessionStorage storage.SqliteStorage) error {
+	agentCtx, stop := context.WithCancel(cmds.ctx)
+
+	agent, err := cmds.newAgent(agentCtx, sessionStorage)
+	if err != nil {
+		stop()
+		return err
+	}
+
+	if cmds.stop != nil {
+		cmds.stop()
+	}
+
+	cmds.agent = agent
+	cmds.storage = sessionStorage
+	cmds.stop = stop
+
+	go cmds.notifications(agentCtx, agent)
+
+	return nil
+}
+
+// notifications prints what the agent says on its own until it is stopped
+func (cmds *commands) notifications(ctx context.Context, agent Agent) {
+	for {
+		select {
+		case msg := <-agent.Notifications():
+			fmt.Fprintf(cmds.out, "\nAgent: > %s\nInput: > ", msg)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run executes a slash command, e.g. "/search rome"
+func (cmds *commands) run(input string) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(input), " ")
+	arg = strings.TrimSpace(arg)
+
+	var err error
+
+	switch name {
+	case "/context":
+		cmds.context()
+	case "/messages":
+		cmds.messages()
+	case "/search":
+		err = cmds.search(arg)
+	case "/memorize":
+		err = cmds.agent.Memorize()
+		if err == nil {
+			fmt.Fprintln(cmds.out, "Messages moved to long term memory.")
+		}
+	case "/reset":
+		err = cmds.agent.Reset()
+		if err == nil {
+			fmt.Fprintln(cmds.out, "Short term memory cleared.")
+		}
+	case "/sessions":
+		err = cmds.sessions()
+	case "/switch":
+		err = cmds.switchSession(arg)
+	case "/export":
+		err = cmds.export(arg)
+	case "/stats":
+		err = cmds.stats()
+	case "/debug":
+		err = cmds.debug(arg)
+	case "/help":
+		fmt.Fprintln(cmds.out, commandsHelp)
+	default:
+		fmt.Fprintf(cmds.out, "Unknown command %s, type /help for the commands.\n", name)
+	}
+
+	if err != nil {
+		fmt.Fprintf(cmds.out, "Error: %v\n", err)
+	}
+}
+
+func (cmds *commands) context() {
+	workingContext := cmds.agent.WorkingContext()
+	if strings.TrimSpace(workingContext) == "" {
+		fmt.Fprintln(cmds.out, "The working context is empty.")
+		return
+	}
+
+	fmt.Fprintln(cmds.out, workingContext)
+}
+
+func (cmds *commands) messages() {
+	msgs := cmds.agent.Messages()
+	if len(msgs) == 0 {
+		fmt.Fprintln(cmds.out, "No messages in short term memory.")
+		return
+	}
+
+	writer := tabwriter.NewWriter(cmds.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "#\tROLE\tTOKENS\tPINNED\tMESSAGE")
+
+	tokens := 0
+	for i, msg := range msgs {
+		pinned := ""
+		if msg.Pinned {
+			pinned = "yes"
+		}
+
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%s\t%s\n", i+1, msg.Role, msg.Tokens, pinned, preview(msg.Text, 80))
+		tokens += msg.Tokens
+	}
+
+	writer.Flush()
+	fmt.Fprintf(cmds.out, "%d messages, %d tokens\n", len(msgs), tokens)
+}
+
+func (cmds *commands) search(query string) error {
+	if query == "" {
+		return fmt.Errorf("usage: /search <query>")
+	}
+
+	passages, err := cmds.agent.Search(query, 1)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cmds.out, "Archival memory:")
+	fmt.Fprintln(cmds.out, passages)
+
+	history, err := cmds.agent.SearchHistory(memory.RecallQuery{Search: query, Limit: 10})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmds.out, "\nConversation history, %d of %d messages:\n", len(history.Messages), history.Total)
+	for _, msg := range history.Messages {
+		fmt.Fprintln(cmds.out, preview(msg.String(), 120))
+	}
+
+	return nil
+}
+
+func (cmds *commands) sessions() error {
+	sessions, err := cmds.storage.Sessions()
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(cmds.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "\tSESSION\tMESSAGES\tLAST MESSAGE")
+
+	for _, session := range sessions {
+		current := ""
+		if session.ID == cmds.storage.SessionID() {
+			current = "*"
+		}
+
+		last := "-"
+		if !session.LastMessage.IsZero() {
+			last = session.LastMessage.Local().Format("2006-01-02 15:04")
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\n", current, session.ID, session.Messages, last)
+	}
+
+	return writer.Flush()
+}
+
+func (cmds *commands) switchSession(sessionID string) error {
+	if sessionID == "" {
+		return fmt.Errorf("usage: /switch <session id>")
+	}
+
+	if sessionID == cmds.storage.SessionID() {
+		fmt.Fprintf(cmds.out, "Already in session %s.\n", sessionID)
+		return nil
+	}
+
+	err := cmds.start(cmds.storage.Session(sessionID))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmds.out, "Switched to session %s.\n", sessionID)
+	printHistory(cmds.storage)
+
+	return nil
+}
+
+func (cmds *commands) export(path string) error {
+	if path == "" {
+		path = cmds.storage.SessionID() + ".json"
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	err = cmds.storage.Export(file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmds.out, "Session %s exported to %s.\n", cmds.storage.SessionID(), path)
+
+	return nil
+}
+
+func (cmds *commands) stats() error {
+	fmt.Fprintln(cmds.out, cmds.agent.Stats())
+
+	report, err := cmds.agent.Usage(memory.UsageQuery{})
+	if err != nil {
+		return err
+	}
+
+	promptTokens, completionTokens := report.Tokens()
+	fmt.Fprintf(cmds.out, "Token usage: %d prompt, %d completion tokens, about $%.4f\n", promptTokens, completionTokens, report.Cost)
+
+	return nil
+}
+
+func (cmds *commands) debug(arg string) error {
+	switch arg {
+	case "on":
+		cmds.logLevel.Set(slog.LevelDebug)
+	case "off":
+		cmds.logLevel.Set(cmds.level)
+	default:
+		return fmt.Errorf("usage: /debug on|off")
+	}
+
+	fmt.Fprintf(cmds.out, "Logging at %s level.\n", cmds.logLevel.Level())
+
+	return nil
+}
+
+// preview shortens the text to a single line of at most n runes
+func preview(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > n {
+		return string(runes[:n]) + "..."
+	}
+
+	return text
+}
@@ -0,0 +1,80 @@
+package eval
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory/memorytest"
+)
+
+func TestRun(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.Text("Nice to meet you, Ana."),
+		memorytest.Text("Your dog is called Pixel."),
+		memorytest.Text("You live in Porto."),
+	)
+
+	judge := memorytest.NewModel(
+		memorytest.Text("PASS"),
+		memorytest.Text("FAIL"),
+	)
+
+	scenario := Scenario{
+		Name: "dog",
+		Sessions: []Session{
+			{Messages: []string{"I'm Ana, my dog is called Pixel and I live in Lisbon."}},
+			{Questions: []Question{
+				{Ask: "What's my dog called?", Expect: []string{"pixel"}},
+				{Ask: "Where do I live?", Expect: []string{"Lisbon"}},
+			}},
+		},
+	}
+
+	runner := NewRunner(model, WithJudge(judge), WithDir(t.TempDir()), WithTurnTimeout(5*time.Second))
+
+	result, err := runner.Run(context.Background(), scenario)
+	if err != nil {
+		t.Fatalf("running scenario: %v", err)
+	}
+
+	if err := model.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Total != 2 || result.Passed != 1 {
+		t.Fatalf("passed %d of %d questions, want 1 of 2", result.Passed, result.Total)
+	}
+
+	if !result.Answers[0].Match || result.Answers[1].Match {
+		t.Errorf("exact match results are %v and %v", result.Answers[0].Match, result.Answers[1].Match)
+	}
+
+	if result.Turns != 3 || result.Calls != 3 {
+		t.Errorf("got %d turns and %d calls, want 3 and 3", result.Turns, result.Calls)
+	}
+
+	out := &bytes.Buffer{}
+	err = Report(out, []Result{result})
+	if err != nil {
+		t.Fatalf("writing report: %v", err)
+	}
+
+	if !strings.Contains(out.String(), "Where do I live?") {
+		t.Errorf("report doesn't list the failed question:\n%s", out.String())
+	}
+}
+
+func TestMatches(t *testing.T) {
+	question := Question{Expect: []string{"14th of March", "March 14"}}
+
+	if !question.matches("The release is due on march 14.") {
+		t.Error("expected a case insensitive match")
+	}
+
+	if question.matches("The release is due in April.") {
+		t.Error("unexpected match")
+	}
+}
@@ -0,0 +1,68 @@
+package eval
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// meter counts the calls, tool calls and tokens of the wrapped model
+type meter struct {
+	llm llms.Model
+
+	mu               sync.Mutex
+	calls            int
+	promptTokens     int
+	completionTokens int
+	toolCalls        map[string]int
+}
+
+func newMeter(llm llms.Model) *meter {
+	return &meter{
+		llm:       llm,
+		toolCalls: map[string]int{},
+	}
+}
+
+func (meter *meter) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	response, err := meter.llm.GenerateContent(ctx, messages, options...)
+
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+
+	meter.calls++
+
+	if err != nil {
+		return response, err
+	}
+
+	for _, choice := range response.Choices {
+		promptTokens, completionTokens := memory.TokenUsage(choice.GenerationInfo)
+		meter.promptTokens += promptTokens
+		meter.completionTokens += completionTokens
+
+		for _, toolCall := range choice.ToolCalls {
+			meter.toolCalls[toolCall.FunctionCall.Name]++
+		}
+	}
+
+	return response, nil
+}
+
+func (meter *meter) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, meter, prompt, options...)
+}
+
+func (meter *meter) totals() (calls int, promptTokens int, completionTokens int, toolCalls map[string]int) {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+
+	toolCalls = map[string]int{}
+	for name, count := range meter.toolCalls {
+		toolCalls[name] = count
+	}
+
+	return meter.calls, meter.promptTokens, meter.completionTokens, toolCalls
+}
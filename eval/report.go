@@ -0,0 +1,77 @@
+package eval
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Report writes a table with the metrics of each scenario followed
+// by the failed questions.
+func Report(w io.Writer, results []Result) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(table, "SCENARIO\tRETENTION\tARCHIVED\tPASSAGES\tTURNS\tCALLS\tPROMPT TOKENS\tCOMPLETION TOKENS\tTOOL CALLS\tDURATION")
+
+	passed, total := 0, 0
+	for _, result := range results {
+		passed += result.Passed
+		total += result.Total
+
+		fmt.Fprintf(table, "%s\t%d/%d (%.0f%%)\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			result.Scenario,
+			result.Passed, result.Total, result.Retention()*100,
+			result.Archived,
+			result.Passages,
+			result.Turns,
+			result.Calls,
+			result.PromptTokens,
+			result.CompletionTokens,
+			formatToolCalls(result.ToolCalls),
+			result.Duration.Round(1e6),
+		)
+	}
+
+	err := table.Flush()
+	if err != nil {
+		return err
+	}
+
+	if total > 0 {
+		fmt.Fprintf(w, "\nOverall retention: %d/%d (%.0f%%)\n", passed, total, float64(passed)/float64(total)*100)
+	}
+
+	for _, result := range results {
+		for _, answer := range result.Answers {
+			if answer.Passed() {
+				continue
+			}
+
+			fmt.Fprintf(w, "\nFAILED %s, session %d\n  Q: %s\n  A: %s\n", result.Scenario, answer.Session, answer.Question, answer.Answer)
+		}
+	}
+
+	return nil
+}
+
+func formatToolCalls(toolCalls map[string]int) string {
+	if len(toolCalls) == 0 {
+		return "-"
+	}
+
+	names := make([]string, 0, len(toolCalls))
+	for name := range toolCalls {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	counts := make([]string, 0, len(names))
+	for _, name := range names {
+		counts = append(counts, fmt.Sprintf("%s=%d", name, toolCalls[name]))
+	}
+
+	return strings.Join(counts, ",")
+}
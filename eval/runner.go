@@ -0,0 +1,335 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/storage"
+	"github.com/tmc/langchaingo/llms"
+)
+
+var (
+	defaultContextSize = 2048
+	defaultTurnTimeout = 2 * time.Minute
+)
+
+// Answer is the agent's answer to a question of the scenario.
+type Answer struct {
+	Session  int    `json:"session"`
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+
+	// exact match result and the judge's verdict when a judge is set
+	Match  bool  `json:"match"`
+	Judged *bool `json:"judged,omitempty"`
+}
+
+// Passed prefers the judge's verdict over exact match.
+func (answer Answer) Passed() bool {
+	if answer.Judged != nil {
+		return *answer.Judged
+	}
+
+	return answer.Match
+}
+
+// Result holds the retention metrics of a scenario run.
+type Result struct {
+	Scenario string   `json:"scenario"`
+	Answers  []Answer `json:"answers"`
+	Passed   int      `json:"passed"`
+	Total    int      `json:"total"`
+
+	// messages moved to long term memory during the run
+	Archived int `json:"archived"`
+	Passages int `json:"passages"`
+
+	Turns            int            `json:"turns"`
+	Calls            int            `json:"calls"`
+	ToolCalls        map[string]int `json:"toolCalls"`
+	PromptTokens     int            `json:"promptTokens"`
+	CompletionTokens int            `json:"completionTokens"`
+	Duration         time.Duration  `json:"duration"`
+}
+
+// Retention is the share of questions answered correctly.
+func (result Result) Retention() float64 {
+	if result.Total == 0 {
+		return 0
+	}
+
+	return float64(result.Passed) / float64(result.Total)
+}
+
+// Runner runs scenarios against a model, each scenario gets its own database.
+type Runner struct {
+	llm         llms.Model
+	judge       llms.Model
+	dir         string
+	contextSize int
+	turnTimeout time.Duration
+	opts        []memory.ProcessorOption
+	logger      *slog.Logger
+}
+
+type RunnerOption func(*Runner)
+
+// WithJudge grades the answers with a model in addition to exact match.
+func WithJudge(judge llms.Model) RunnerOption {
+	return func(runner *Runner) {
+		runner.judge = judge
+	}
+}
+
+// WithContextSize sets the context window of the agent, small
+// windows force evictions early in the conversation.
+func WithContextSize(tokens int) RunnerOption {
+	return func(runner *Runner) {
+		runner.contextSize = tokens
+	}
+}
+
+// WithTurnTimeout sets how long to wait for the agent's reply.
+func WithTurnTimeout(timeout time.Duration) RunnerOption {
+	return func(runner *Runner) {
+		runner.turnTimeout = timeout
+	}
+}
+
+// WithDir stores the scenario databases in dir instead of a temporary directory.
+func WithDir(dir string) RunnerOption {
+	return func(runner *Runner) {
+		runner.dir = dir
+	}
+}
+
+// WithLogger logs failed judgements and timed out turns.
+func WithLogger(logger *slog.Logger) RunnerOption {
+	return func(runner *Runner) {
+		runner.logger = logger
+	}
+}
+
+// WithProcessorOptions configures the agent under evaluation.
+func WithProcessorOptions(opts ...memory.ProcessorOption) RunnerOption {
+	return func(runner *Runner) {
+		runner.opts = append(runner.opts, opts...)
+	}
+}
+
+func NewRunner(llm llms.Model, opts ...RunnerOption) *Runner {
+	runner := &Runner{
+		llm:         llm,
+		contextSize: defaultContextSize,
+		turnTimeout: defaultTurnTimeout,
+		logger:      memory.NopLogger(),
+	}
+
+	for _, opt := range opts {
+		opt(runner)
+	}
+
+	return runner
+}
+
+func (runner *Runner) Run(ctx context.Context, scenario Scenario) (Result, error) {
+	dir := runner.dir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "gomemgpt-eval-")
+		if err != nil {
+			return Result{}, err
+		}
+		defer os.RemoveAll(tmp)
+
+		dir = tmp
+	}
+
+	db := storage.NewSqliteStorage(storage.WithPath(filepath.Join(dir, fileName(scenario.Name)+".db")))
+	if db.DB == nil {
+		return Result{}, errors.New("opening scenario storage failed")
+	}
+
+	if sqlDB, err := db.DB.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	model := newMeter(runner.llm)
+	result := Result{
+		Scenario:  scenario.Name,
+		Answers:   []Answer{},
+		ToolCalls: map[string]int{},
+	}
+
+	start := time.Now()
+
+	for i, session := range scenario.Sessions {
+		answers, err := runner.runSession(ctx, model, db, i+1, session, &result)
+		if err != nil {
+			return result, fmt.Errorf("session %d: %w", i+1, err)
+		}
+
+		result.Answers = append(result.Answers, answers...)
+	}
+
+	result.Duration = time.Since(start)
+	result.Calls, result.PromptTokens, result.CompletionTokens, result.ToolCalls = model.totals()
+
+	for _, answer := range result.Answers {
+		result.Total++
+		if answer.Passed() {
+			result.Passed++
+		}
+	}
+
+	msgStats, err := db.MessageStats()
+	if err == nil {
+		result.Archived = msgStats.Archived
+	}
+
+	passageStats, err := db.PassageStats()
+	if err == nil {
+		result.Passages = passageStats.Passages
+	}
+
+	return result, nil
+}
+
+func (runner *Runner) runSession(ctx context.Context, model llms.Model, db storage.SqliteStorage, number int, session Session, result *Result) ([]Answer, error) {
+	mainContext := memory.NewMemoryContext(db, memory.WithContextSize(runner.contextSize))
+
+	processor, err := memory.NewLLMProcessor(model, mainContext, runner.opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer close(done)
+		processor.Run(sessionCtx, wg)
+	}()
+
+	wg.Wait()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for _, text := range session.Messages {
+		result.Turns++
+		runner.turn(processor, text)
+	}
+
+	answers := []Answer{}
+	for _, question := range session.Questions {
+		result.Turns++
+
+		reply := runner.turn(processor, question.Ask)
+		answer := Answer{
+			Session:  number,
+			Question: question.Ask,
+			Answer:   reply,
+			Match:    question.matches(reply),
+		}
+
+		if runner.judge != nil {
+			verdict, err := runner.grade(ctx, question, reply)
+			if err != nil {
+				runner.logger.Error("judging answer", "question", question.Ask, "error", err)
+			} else {
+				answer.Judged = &verdict
+			}
+		}
+
+		answers = append(answers, answer)
+	}
+
+	return answers, nil
+}
+
+// turn sends the message and waits for the agent to finish the turn,
+// the replies are joined. Replies of a timed out turn are dropped.
+func (runner *Runner) turn(processor *memory.LLMProcessor, text string) string {
+	msg := llms.TextParts(llms.ChatMessageTypeHuman, text)
+
+	// the replies are only read once the turn is done
+	replies := []string{}
+	done := make(chan struct{})
+
+	processor.Call(msg, func(reply llms.MessageContent) {
+		replies = append(replies, combineText(reply))
+	}, func() {
+		close(done)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(runner.turnTimeout):
+		runner.logger.Warn("turn timed out", "message", text, "timeout", runner.turnTimeout)
+		return ""
+	}
+
+	return strings.Join(replies, "\n")
+}
+
+var judgePrompt = `You are grading whether an AI assistant remembered a fact.
+
+Question: %s
+Expected answer (any of): %s
+Assistant's answer: %s
+
+Reply with PASS if the assistant's answer contains the expected fact, otherwise reply with FAIL.`
+
+func (runner *Runner) grade(ctx context.Context, question Question, answer string) (bool, error) {
+	prompt := fmt.Sprintf(judgePrompt, question.Ask, strings.Join(question.Expect, ", "), answer)
+
+	verdict, err := llms.GenerateFromSinglePrompt(ctx, runner.judge, prompt)
+	if err != nil {
+		return false, err
+	}
+
+	verdict = strings.ToUpper(strings.TrimSpace(verdict))
+
+	switch {
+	case strings.HasPrefix(verdict, "PASS"):
+		return true, nil
+	case strings.HasPrefix(verdict, "FAIL"):
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected verdict %q", verdict)
+	}
+}
+
+func combineText(msg llms.MessageContent) string {
+	text := ""
+	for _, part := range msg.Parts {
+		if content, ok := part.(llms.TextContent); ok {
+			text += content.Text
+		}
+	}
+
+	return text
+}
+
+func fileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' {
+			return '-'
+		}
+
+		return r
+	}, name)
+}
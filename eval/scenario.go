@@ -0,0 +1,63 @@
+// Package eval measures how well the agent retains facts over long,
+// multi-session conversations, so changes to eviction, summarization
+// and recall can be compared.
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Scenario is a scripted conversation, each session runs on a fresh
+// processor sharing the scenario's storage, the same as a restart.
+type Scenario struct {
+	Name     string    `json:"name"`
+	Sessions []Session `json:"sessions"`
+}
+
+// Session sends the messages in order and then asks the questions.
+type Session struct {
+	Messages  []string   `json:"messages"`
+	Questions []Question `json:"questions"`
+}
+
+// Question checks the agent remembers a fact, the answer passes exact
+// match when it contains any of the expected strings (case insensitive).
+type Question struct {
+	Ask    string   `json:"ask"`
+	Expect []string `json:"expect"`
+}
+
+func LoadScenarios(path string) ([]Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	scenarios := []Scenario{}
+	err = json.Unmarshal(data, &scenarios)
+	if err != nil {
+		return nil, fmt.Errorf("decoding scenarios %s: %w", path, err)
+	}
+
+	for _, scenario := range scenarios {
+		if scenario.Name == "" {
+			return nil, fmt.Errorf("%s: scenario without a name", path)
+		}
+	}
+
+	return scenarios, nil
+}
+
+func (question Question) matches(answer string) bool {
+	answer = strings.ToLower(answer)
+	for _, expected := range question.Expect {
+		if strings.Contains(answer, strings.ToLower(expected)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/Struki84/GoMemGPT/eval"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// evaluate runs the memory eval scenarios and reports retention, usage:
+// go run . eval [-scenarios eval/scenarios.json] [-context-size 2048] [-judge-model gpt-4o] [-json results.json]
+func evaluate(ctx context.Context, llm llms.Model, logger *slog.Logger, args []string) {
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	scenariosPath := flags.String("scenarios", "eval/scenarios.json", "file with the scenarios to run")
+	contextSize := flags.Int("context-size", 2048, "context window of the agent in tokens, small windows force evictions")
+	judgeModel := flags.String("judge-model", "", "model grading the answers, exact match only when empty")
+	timeout := flags.Duration("timeout", 0, "time to wait for each reply (default 2m)")
+	jsonPath := flags.String("json", "", "also write the results as JSON to the file")
+	flags.Parse(args)
+
+	scenarios, err := eval.LoadScenarios(*scenariosPath)
+	if err != nil {
+		log.Fatalf("Error loading scenarios: %v", err)
+	}
+
+	opts := []eval.RunnerOption{
+		eval.WithContextSize(*contextSize),
+		eval.WithLogger(logger),
+	}
+
+	if *timeout > 0 {
+		opts = append(opts, eval.WithTurnTimeout(*timeout))
+	}
+
+	if *judgeModel != "" {
+		judge, err := openai.New(openai.WithModel(*judgeModel))
+		if err != nil {
+			log.Fatalf("Error initializing judge: %v", err)
+		}
+
+		opts = append(opts, eval.WithJudge(judge))
+	}
+
+	runner := eval.NewRunner(llm, opts...)
+
+	results := []eval.Result{}
+	for _, scenario := range scenarios {
+		log.Printf("Running scenario %s", scenario.Name)
+
+		result, err := runner.Run(ctx, scenario)
+		if err != nil {
+			log.Printf("Error running scenario %s: %v", scenario.Name, err)
+			continue
+		}
+
+		results = append(results, result)
+	}
+
+	err = eval.Report(os.Stdout, results)
+	if err != nil {
+		log.Printf("Error writing report: %v", err)
+	}
+
+	if *jsonPath != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			log.Fatalf("Error encoding results: %v", err)
+		}
+
+		err = os.WriteFile(*jsonPath, data, 0o644)
+		if err != nil {
+			log.Fatalf("Error writing results: %v", err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/tmc/langchaingo/embeddings"
+)
+
+// ingest loads files into archival memory, usage:
+// go run . ingest [-chunk-size 512] [-chunk-overlap 100] [-tags a,b] files...
+func ingest(ctx context.Context, storage memory.MemoryStorage, embedder embeddings.Embedder, logger *slog.Logger, args []string) {
+	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
+	chunkSize := flags.Int("chunk-size", 512, "size of the chunks in characters")
+	chunkOverlap := flags.Int("chunk-overlap", 100, "overlap between chunks in characters")
+	tags := flags.String("tags", "", "comma separated tags added to every chunk")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Println("Usage: ingest [-chunk-size N] [-chunk-overlap N] [-tags a,b] files...")
+		return
+	}
+
+	chunkTags := []string{}
+	if *tags != "" {
+		chunkTags = strings.Split(*tags, ",")
+	}
+
+	// the chunk embeddings are billed to the session like the agent's
+	embedder = memory.MeteredEmbedder(memory.NamedEmbedder(embedder, embeddingModelName), storage, logger)
+
+	ingestor := memory.NewIngestor(storage, embedder,
+		memory.WithChunkSize(*chunkSize),
+		memory.WithChunkOverlap(*chunkOverlap),
+	)
+
+	for _, path := range flags.Args() {
+		chunks, err := ingestor.IngestFile(ctx, path, chunkTags...)
+		if err != nil {
+			log.Printf("Error ingesting %s: %v", path, err)
+			continue
+		}
+
+		fmt.Printf("Ingested %s: %d chunks\n", path, chunks)
+	}
+}
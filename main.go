@@ -8,55 +8,118 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/memory/memorytest"
 	"github.com/Struki84/GoMemGPT/storage"
+	"github.com/tmc/langchaingo/embeddings"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/llms/openai"
 )
 
+// the default openai embedding model, named for the usage accounting
+const embeddingModelName = "text-embedding-ada-002"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	memoryStorage := storage.NewSqliteStorage()
-	llm, err := openai.New(openai.WithModel("gpt-4o"))
+	logOutput := io.Writer(os.Stderr)
+	if len(os.Args) > 1 && os.Args[1] == "tui" {
+		// the inspector takes over the terminal
+		logFile, err := os.OpenFile("gomemgpt.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("Error opening log file: %v", err)
+		}
+
+		defer logFile.Close()
+
+		log.SetOutput(logFile)
+		logOutput = logFile
+	}
+
+	logger, logLevel := newLogger(os.Getenv("GOMEMGPT_LOG_LEVEL"), logOutput)
 
+	shutdownTracing, err := setupTracing(ctx)
 	if err != nil {
-		log.Printf("Error initializing LLM: %v", err)
+		log.Fatalf("Error initializing tracing: %v", err)
 	}
 
-	chatAgent := NewAgent(ctx, llm, memoryStorage)
+	defer shutdownTracing(context.Background())
 
-	scanner := bufio.NewScanner(os.Stdin)
+	memoryStorage := storage.NewSqliteStorage(storage.WithLogger(logger))
+	modelName := "gpt-4o"
+	llm, err := openai.New(openai.WithModel(modelName))
 
-	fmt.Println("Type a message (or 'exit' to quit): ")
+	if err != nil {
+		log.Printf("Error initializing LLM: %v", err)
+	}
 
-	msgsHistory, err := memoryStorage.LoadMessages()
+	// archival memory falls back to text search without an embedder
+	var embedder embeddings.Embedder
+	openaiEmbedder, err := embeddings.NewEmbedder(llm)
+	if err != nil {
+		log.Printf("Error initializing embedder: %v", err)
+	} else {
+		embedder = openaiEmbedder
+	}
 
-	// log.Println("Loaded messages:", len(msgsHistory))
+	// record the session into a cassette for replay tests
+	var model llms.Model = llm
+	if cassette := os.Getenv("GOMEMGPT_RECORD"); cassette != "" {
+		model = memorytest.NewRecorder(llm, cassette)
+	}
 
-	if len(msgsHistory) > 0 {
+	if len(os.Args) > 1 && os.Args[1] == "ingest" {
+		ingest(ctx, memoryStorage, embedder, logger, os.Args[2:])
+		return
+	}
 
-		// msgsHistory = msgsHistory[1:]
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		usage(memoryStorage, os.Args[2:])
+		return
+	}
 
-		for _, msg := range msgsHistory {
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		evaluate(ctx, model, logger, os.Args[2:])
+		return
+	}
 
-			role := ""
-			if msg.Role == "human" {
-				role = "Input: >"
-			} else {
-				role = "Output: >"
-			}
+	metricsOpts := setupMetrics(logger)
+
+	// a new agent is started on the session after /switch
+	newChatAgent := func(ctx context.Context, sessionStorage storage.SqliteStorage, opts ...AgentOption) (Agent, error) {
+		return NewAgent(ctx, model, sessionStorage, append([]AgentOption{
+			WithContextOptions(memory.WithEmbedder(memory.NamedEmbedder(embedder, embeddingModelName))),
+			WithProcessorOptions(
+				memory.WithLogger(logger.With("session", sessionStorage.SessionID())),
+				memory.WithModelName(modelName),
+			),
+			WithProcessorOptions(metricsOpts...),
+		}, opts...)...)
+	}
 
-			if msg.Parts[0].(llms.TextContent).Text != "preforming function calls" {
-				fmt.Println(fmt.Sprintf("%s %s", role, msg.Parts[0].(llms.TextContent).Text))
-			}
-		}
+	if len(os.Args) > 1 && os.Args[1] == "tui" {
+		inspect(ctx, memoryStorage, newChatAgent)
+		return
 	}
 
+	cmds, err := newCommands(ctx, memoryStorage, logLevel, newChatAgent)
+	if err != nil {
+		log.Fatalf("Error initializing agent: %v", err)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+
+	fmt.Println("Type a message, /help for the commands or 'exit' to quit: ")
+
+	printHistory(memoryStorage)
+
 	for {
 		fmt.Printf("Input: > ")
 		if !scanner.Scan() {
@@ -70,16 +133,52 @@ func main() {
 			break
 		}
 
-		// Create a channel so we can wait for the response.
-		responseChan := make(chan string)
+		if strings.HasPrefix(input, "/") {
+			cmds.run(input)
+			continue
+		}
 
-		// Call the agent, but in the callback, we send the response into responseChan
-		chatAgent.Call(input, func(msg string) {
-			responseChan <- msg
+		// print the replies until the agent is done with the message
+		done := cmds.agent.Call(input, func(msg string) {
+			fmt.Println("Output: >", msg)
 		})
 
-		// BLOCK here until we get a message from responseChan
-		outMsg := <-responseChan
-		fmt.Println("Output: >", outMsg)
+		<-done
+	}
+}
+
+// newLogger logs to the output at the given level (debug, info, warn or error),
+// info by default, debug includes every message the agent handles.
+// The level can be changed while the agent runs.
+func newLogger(level string, output io.Writer) (*slog.Logger, *slog.LevelVar) {
+	logLevel := &slog.LevelVar{}
+
+	err := logLevel.UnmarshalText([]byte(level))
+	if level != "" && err != nil {
+		log.Printf("Unknown log level %q, using info", level)
+		logLevel.Set(slog.LevelInfo)
+	}
+
+	return slog.New(slog.NewTextHandler(output, &slog.HandlerOptions{Level: logLevel})), logLevel
+}
+
+// printHistory prints the conversation in the session's short term memory
+func printHistory(sessionStorage storage.SqliteStorage) {
+	msgsHistory, err := sessionStorage.LoadMessages()
+	if err != nil {
+		return
+	}
+
+	for _, msg := range msgsHistory {
+		role := ""
+		if msg.Role == "human" {
+			role = "Input: >"
+		} else {
+			role = "Output: >"
+		}
+
+		if msg.Parts[0].(llms.TextContent).Text != "preforming function calls" {
+			fmt.Println(fmt.Sprintf("%s %s", role, msg.Parts[0].(llms.TextContent).Text))
+		}
 	}
 }
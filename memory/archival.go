@@ -0,0 +1,49 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// number of archival passages returned per search page
+var archivalPageSize = 5
+
+// Passage is a fact or document the agent chose to store in archival
+// memory, unlike recall memory it is not part of the conversation.
+type Passage struct {
+	Content   string
+	Tags      []string
+	CreatedAt time.Time
+
+	// Source file and chunk number of ingested documents
+	Source string
+	Chunk  int
+
+	// Embedding of the content, empty when no embedder is configured
+	Embedding []float32
+}
+
+func (passage Passage) String() string {
+	result := passage.CreatedAt.Local().Format("2006-01-02 15:04:05") + ": " + passage.Content
+	if len(passage.Tags) > 0 {
+		result += " [tags: " + strings.Join(passage.Tags, ", ") + "]"
+	}
+
+	if passage.Source != "" {
+		result += fmt.Sprintf(" [source: %s, chunk %d]", passage.Source, passage.Chunk)
+	}
+
+	return result
+}
+
+// PassageQuery searches archival memory, passages are ranked by
+// similarity to the embedding when it is set and matched by
+// content and tags otherwise.
+type PassageQuery struct {
+	Search    string
+	Embedding []float32
+
+	Limit  int
+	Offset int
+}
@@ -0,0 +1,186 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Limits caps the usage of the model, zero values are unlimited.
+// Tokens are counted per calendar day and dollars per calendar month,
+// both include the memory operations. Calls are counted over the
+// last minute and don't include embeddings.
+type Limits struct {
+	TokensPerDay    int
+	CallsPerMinute  int
+	DollarsPerMonth float64
+}
+
+func (limits Limits) enabled() bool {
+	return limits.TokensPerDay > 0 || limits.CallsPerMinute > 0 || limits.DollarsPerMonth > 0
+}
+
+type BudgetScope string
+
+const (
+	BudgetSession BudgetScope = "session"
+	BudgetGlobal  BudgetScope = "global"
+)
+
+// BudgetError is returned when a usage limit was reached,
+// the model is not called until it resets.
+type BudgetError struct {
+	Scope BudgetScope
+	Limit string
+	Used  string
+	Max   string
+
+	// when the usage drops below the limit
+	Resets time.Time
+}
+
+func (err *BudgetError) Error() string {
+	return fmt.Sprintf("%s limit of %s reached (%s used)", err.Scope, err.Max, err.Used)
+}
+
+// UserMessage explains to the user why they didn't get a reply.
+func (err *BudgetError) UserMessage() string {
+	return fmt.Sprintf("Usage limit reached: the %s limit of %s was used up (%s). Please try again after %s.",
+		err.Scope, err.Max, err.Used, err.Resets.Format("January 02, 15:04"))
+}
+
+// checkLimits compares the recorded usage of the scope with its limits
+func checkLimits(storage MemoryStorage, pricing Pricing, scope BudgetScope, limits Limits, now time.Time) error {
+	query := UsageQuery{AllSessions: scope == BudgetGlobal}
+
+	if limits.CallsPerMinute > 0 {
+		query.Since = now.Add(-time.Minute)
+
+		totals, err := storage.LoadUsage(query)
+		if err != nil {
+			return err
+		}
+
+		calls := 0
+		for _, total := range totals {
+			if total.Purpose != UsageEmbedding {
+				calls += total.Calls
+			}
+		}
+
+		if calls >= limits.CallsPerMinute {
+			return &BudgetError{
+				Scope:  scope,
+				Limit:  "calls per minute",
+				Used:   fmt.Sprintf("%d calls in the last minute", calls),
+				Max:    fmt.Sprintf("%d calls per minute", limits.CallsPerMinute),
+				Resets: now.Add(time.Minute),
+			}
+		}
+	}
+
+	if limits.TokensPerDay > 0 {
+		query.Since = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+		report, err := LoadUsageReport(storage, query, pricing)
+		if err != nil {
+			return err
+		}
+
+		promptTokens, completionTokens := report.Tokens()
+		if tokens := promptTokens + completionTokens; tokens >= limits.TokensPerDay {
+			return &BudgetError{
+				Scope:  scope,
+				Limit:  "tokens per day",
+				Used:   fmt.Sprintf("%d tokens today", tokens),
+				Max:    fmt.Sprintf("%d tokens per day", limits.TokensPerDay),
+				Resets: query.Since.AddDate(0, 0, 1),
+			}
+		}
+	}
+
+	if limits.DollarsPerMonth > 0 {
+		query.Since = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+		report, err := LoadUsageReport(storage, query, pricing)
+		if err != nil {
+			return err
+		}
+
+		if report.Cost >= limits.DollarsPerMonth {
+			return &BudgetError{
+				Scope:  scope,
+				Limit:  "dollars per month",
+				Used:   fmt.Sprintf("$%.2f this month", report.Cost),
+				Max:    fmt.Sprintf("$%.2f per month", limits.DollarsPerMonth),
+				Resets: query.Since.AddDate(0, 1, 0),
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkBudget returns a BudgetError when a session or global limit was
+// reached, failing to load the usage doesn't block the model
+func (processor *LLMProcessor) checkBudget() error {
+	now := processor.clock.Now()
+
+	for _, budget := range []struct {
+		scope  BudgetScope
+		limits Limits
+	}{
+		{BudgetSession, processor.sessionLimits},
+		{BudgetGlobal, processor.globalLimits},
+	} {
+		if !budget.limits.enabled() {
+			continue
+		}
+
+		err := checkLimits(processor.storage, processor.pricing, budget.scope, budget.limits, now)
+
+		var budgetErr *BudgetError
+		if errors.As(err, &budgetErr) {
+			return err
+		}
+
+		if err != nil {
+			processor.logger.Error("checking usage limits", "scope", budget.scope, "error", err)
+		}
+	}
+
+	// the agent is told again the next time a limit is reached
+	processor.budgetNotified = ""
+
+	return nil
+}
+
+// budgetExceeded tells the user why the model was not called and leaves a
+// system message for the agent, so it can explain once it runs again.
+// Heartbeats, warnings, reminders and events have nobody to tell.
+func (processor *LLMProcessor) budgetExceeded(budgetErr *BudgetError) {
+	processor.logger.Warn("usage limit reached", "scope", budgetErr.Scope, "limit", budgetErr.Limit, "used", budgetErr.Used, "resets", budgetErr.Resets)
+
+	// once per reached limit, the model isn't called to read it
+	key := string(budgetErr.Scope) + budgetErr.Limit
+	if processor.budgetNotified != key {
+		processor.budgetNotified = key
+
+		sysPrompt, err := processor.System.BudgetExceeded(budgetErr)
+		if err != nil {
+			processor.logger.Error("creating usage limit message", "error", err)
+		} else {
+			processor.System.AppendMessage(llms.TextParts(llms.ChatMessageTypeSystem, sysPrompt))
+		}
+	}
+
+	if processor.caller.output == nil {
+		processor.logger.Info("usage limit notice dropped, nobody waits for a reply", "turn", processor.turn)
+		return
+	}
+
+	// the user is answered last, the context is done changing
+	processor.caller.output(llms.TextParts(llms.ChatMessageTypeAI, budgetErr.UserMessage()))
+}
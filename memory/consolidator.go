@@ -0,0 +1,143 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// number of archived messages folded into a single archival passage
+var consolidationBatchSize = 50
+
+// Consolidator uses idle time to tidy up memory ("sleep-time" processing),
+// it reorganizes and deduplicates the working context and summarizes
+// archived message batches into archival passages. It runs on its own,
+// usually cheaper, model and never produces user-visible output.
+type Consolidator struct {
+	llm         llms.Model
+	system      *SystemMonitor
+	mainContext *MemoryContext
+	summarizer  *Summarizer
+	logger      *slog.Logger
+}
+
+func NewConsolidator(llm llms.Model, system *SystemMonitor, mainContext *MemoryContext, summarizer *Summarizer) *Consolidator {
+	return &Consolidator{
+		llm:         llm,
+		system:      system,
+		mainContext: mainContext,
+		summarizer:  summarizer,
+		logger:      NopLogger(),
+	}
+}
+
+// ConsolidateWorkingContext reorganizes the working context and removes duplicated facts.
+func (consolidator *Consolidator) ConsolidateWorkingContext(ctx context.Context) error {
+	if strings.TrimSpace(consolidator.mainContext.WorkingContext) == "" {
+		return nil
+	}
+
+	prompt, err := consolidator.system.ConsolidateWorkingContextPrompt(consolidator.mainContext.WorkingContext, int(consolidator.mainContext.workingCtxSize))
+	if err != nil {
+		return err
+	}
+
+	workingContext, err := consolidator.generate(ctx, prompt)
+	if err != nil {
+		return err
+	}
+
+	workingContext, err = consolidator.summarizer.Fit(ctx, workingContext, int(consolidator.mainContext.workingCtxSize))
+	if err != nil {
+		return err
+	}
+
+	err = consolidator.mainContext.Storage.SaveWorkingContext(workingContext)
+	if err != nil {
+		return err
+	}
+
+	consolidator.mainContext.WorkingContext = workingContext
+
+	return nil
+}
+
+// ConsolidateArchive folds the next batch of archived messages into an
+// archival passage, it returns false once no messages are left.
+func (consolidator *Consolidator) ConsolidateArchive(ctx context.Context) (bool, error) {
+	storage := consolidator.mainContext.Storage
+
+	msgs, err := storage.LoadUnconsolidatedMessages(consolidationBatchSize)
+	if err != nil {
+		return false, err
+	}
+
+	if len(msgs) == 0 {
+		return false, nil
+	}
+
+	transcript := ""
+	ids := []uint{}
+	for _, msg := range msgs {
+		transcript += msg.String() + "\n"
+		ids = append(ids, msg.ID)
+	}
+
+	prompt, err := consolidator.system.ConsolidateArchivePrompt(transcript)
+	if err != nil {
+		return false, err
+	}
+
+	summary, err := consolidator.generate(ctx, prompt)
+	if err != nil {
+		return false, err
+	}
+
+	passage := Passage{
+		Content: summary,
+		Tags:    []string{"consolidated"},
+		Source:  fmt.Sprintf("conversation %s - %s", msgs[0].CreatedAt.Local().Format("2006-01-02 15:04"), msgs[len(msgs)-1].CreatedAt.Local().Format("2006-01-02 15:04")),
+	}
+
+	if consolidator.mainContext.Embedder != nil {
+		embedding, err := consolidator.mainContext.Embedder.EmbedQuery(ctx, summary)
+		if err != nil {
+			return false, err
+		}
+
+		passage.Embedding = embedding
+	}
+
+	err = storage.InsertPassages([]Passage{passage})
+	if err != nil {
+		return false, err
+	}
+
+	err = storage.ConsolidateMessages(ids)
+	if err != nil {
+		return false, err
+	}
+
+	// a short batch was the last one
+	return len(msgs) == consolidationBatchSize, nil
+}
+
+func (consolidator *Consolidator) generate(ctx context.Context, prompt string) (string, error) {
+	response, err := consolidator.llm.GenerateContent(ctx, []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, prompt),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(response.Choices) == 0 || strings.TrimSpace(response.Choices[0].Content) == "" {
+		return "", errors.New("consolidation model returned an empty response")
+	}
+
+	return response.Choices[0].Content, nil
+}
@@ -0,0 +1,99 @@
+package memory_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/memory/memorytest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestConsolidationYieldsToMessages(t *testing.T) {
+	path := dbPath(t)
+
+	// two batches of archived messages
+	db := openStorage(t, path)
+	archived := conversation(60)
+	if err := db.SaveMessages(archived); err != nil {
+		t.Fatalf("saving messages: %v", err)
+	}
+
+	if err := db.ArchiveMessages(archived); err != nil {
+		t.Fatalf("archiving messages: %v", err)
+	}
+
+	passages := func(want int) func(msgs []llms.MessageContent) error {
+		return func(msgs []llms.MessageContent) error {
+			stats, err := db.PassageStats()
+			if err != nil {
+				return err
+			}
+
+			if stats.Passages != want {
+				return fmt.Errorf("passages = %d, want %d", stats.Passages, want)
+			}
+
+			return nil
+		}
+	}
+
+	var h *harness
+
+	consolidationModel := memorytest.NewModel(
+		// the user writes while the first batch is folded
+		memorytest.Text("Ana talked about her trip to Rome.").
+			Expect(func(msgs []llms.MessageContent) error {
+				h.say("Are you there?")
+				return nil
+			}),
+		memorytest.Text("Ana kept talking about Rome.").
+			Expect(passages(1)),
+	)
+
+	// the user's turn runs between the two batches
+	model := memorytest.NewModel(
+		memorytest.Text("I'm here.").
+			Expect(passages(1)),
+	)
+
+	clock := memorytest.NewClock(time.Date(2024, 5, 6, 8, 0, 0, 0, time.UTC))
+	h = newHarness(t, path, model, nil,
+		memory.WithClock(clock),
+		memory.WithConsolidation(consolidationModel, time.Minute),
+	)
+
+	h.start()
+
+	// tasks wake the loop without moving the idle timer
+	for i := 0; i < 50; i++ {
+		h.processor.Do(func(ctx context.Context) {})
+	}
+
+	clock.Advance(time.Minute)
+
+	if output := h.waitOutput(); output != "I'm here." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.waitTurn()
+
+	// the cycle starts over once the conversation is idle again
+	clock.Advance(time.Minute)
+	h.waitCall(consolidationModel)
+	h.waitCall(consolidationModel)
+
+	h.stop()
+	h.checkModel(consolidationModel)
+
+	stats, err := h.storage.PassageStats()
+	if err != nil || stats.Passages != 2 {
+		t.Errorf("passages = %d, %v, want 2", stats.Passages, err)
+	}
+
+	if timers := clock.Timers(); timers != 1 {
+		t.Errorf("created %d timers, want a single idle timer", timers)
+	}
+}
@@ -1,19 +1,31 @@
 package memory
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
+	"sync"
 
 	"github.com/pkoukk/tiktoken-go"
+	"github.com/tmc/langchaingo/embeddings"
 	"github.com/tmc/langchaingo/llms"
 )
 
 var (
 	maxContextSize    float32 = 4096
-	maxMsgsSize       float32 = 0.7
+	maxMsgsSize       float32 = 0.6
 	maxWorkingCtxSize float32 = 0.3
+	maxSummarySize    float32 = 0.1
+
+	// share of the messages budget that pinned messages can take up
+	maxPinnedSize float32 = 0.5
 )
 
+// ErrNoNewMessages is returned by SaveMessages when every message
+// was already saved, callers that only need the messages stored ignore it.
+var ErrNoNewMessages = errors.New("no new messages to save")
+
 type MemoryStorage interface {
 	LoadMessages() ([]llms.MessageContent, error)
 	SaveMessages(messages []llms.MessageContent) error
@@ -21,8 +33,31 @@ type MemoryStorage interface {
 	LoadWorkingContext() (string, error)
 	SaveWorkingContext(workingContext string) error
 
-	RecallMessages(query string, limit, offset int) (string, error)
+	LoadSummary() (string, error)
+	SaveSummary(summary string) error
+
+	RecallMessages(query RecallQuery) (RecallResult, error)
 	ArchiveMessages(messages []llms.MessageContent) error
+
+	LoadUnconsolidatedMessages(limit int) ([]RecalledMessage, error)
+	ConsolidateMessages(ids []uint) error
+
+	MessageStats() (MessageStats, error)
+	PassageStats() (PassageStats, error)
+
+	SaveUsage(usage Usage) error
+	LoadUsage(query UsageQuery) ([]UsageTotal, error)
+
+	LoadPinnedMessages() ([]llms.MessageContent, error)
+	PinMessage(message llms.MessageContent, pinned bool) error
+	TagMessage(message llms.MessageContent, tags []string) error
+
+	InsertPassages(passages []Passage) error
+	SearchPassages(query PassageQuery) ([]Passage, int, error)
+
+	LoadReminders() ([]Reminder, error)
+	SaveReminder(reminder Reminder) (Reminder, error)
+	CompleteReminder(id uint) error
 }
 
 // Main memory context
@@ -30,9 +65,9 @@ type MemoryContext struct {
 	// FIFO Message Queue, stores a rolling history of messages,
 	// including  messages between the agent and user, as well as system
 	// messages (e.g. memory warnings) and function call inputs
-	// and outputs. The first index in the FIFO queue stores a system
-	// message containing a recursive summary of messages that have
-	// been evicted from the queue.
+	// and outputs. The head of the FIFO queue stores the primer system
+	// message followed by a system message containing a recursive
+	// summary of messages that have been evicted from the queue.
 	Messages []llms.MessageContent
 
 	// Current working context
@@ -40,12 +75,34 @@ type MemoryContext struct {
 	// writeable only via MemGPT function calls.
 	WorkingContext string
 
+	// Recursive summary of the evicted messages, maintained by the
+	// system on every eviction and rendered at the head of the FIFO queue.
+	Summary string
+
 	// Intarface for perfomring operations on the data storage
 	Storage MemoryStorage
 
+	// Policy deciding which messages are moved to long term memory
+	// when the FIFO queue is flushed
+	Eviction EvictionPolicy
+
+	// Embedder used for archival memory similarity search,
+	// archival memory falls back to text search when nil
+	Embedder embeddings.Embedder
+
+	// Pinned messages never leave the FIFO queue, they are
+	// keyed by role and content same as in the storage
+	pinned map[string]struct{}
+
+	// number of system messages at the head of the FIFO queue
+	headSize int
+
+	logger *slog.Logger
+
 	contextSize    float32
 	msgsSize       float32
 	workingCtxSize float32
+	summarySize    float32
 }
 
 // MemoryContext can be viewd as state, or core memory with
@@ -56,63 +113,284 @@ type MemoryContext struct {
 // more persisttance storage and archival storage.
 
 // When chat history queue is full, the oldest messages are evicted
-// from the queue and summerized into current working context.
+// from the queue and summerized into the recursive summary.
 
 // core memory - fixed size memory context with its state saved in persistance storage db
 // archive memory - unlimited size db storage for all messages and contexts
 
-func NewMemoryContext(storage MemoryStorage) *MemoryContext {
-	return &MemoryContext{
+type ContextOption func(*MemoryContext)
+
+func WithEvictionPolicy(policy EvictionPolicy) ContextOption {
+	return func(memory *MemoryContext) {
+		memory.Eviction = policy
+	}
+}
+
+func WithEmbedder(embedder embeddings.Embedder) ContextOption {
+	return func(memory *MemoryContext) {
+		memory.Embedder = embedder
+	}
+}
+
+// WithContextSize sets the token size of the context window,
+// the section budgets are shares of it.
+func WithContextSize(tokens int) ContextOption {
+	return func(memory *MemoryContext) {
+		memory.contextSize = float32(tokens)
+		memory.msgsSize = float32(tokens) * maxMsgsSize
+		memory.workingCtxSize = float32(tokens) * maxWorkingCtxSize
+		memory.summarySize = float32(tokens) * maxSummarySize
+	}
+}
+
+func NewMemoryContext(storage MemoryStorage, opts ...ContextOption) *MemoryContext {
+	memory := &MemoryContext{
 		Messages:       make([]llms.MessageContent, 0),
 		Storage:        storage,
+		Eviction:       KeepToolPairs(KeepLastN(3)),
+		pinned:         map[string]struct{}{},
 		contextSize:    maxContextSize,
 		msgsSize:       maxContextSize * maxMsgsSize,
 		workingCtxSize: maxContextSize * maxWorkingCtxSize,
+		summarySize:    maxContextSize * maxSummarySize,
+		logger:         NopLogger(),
+	}
+
+	for _, opt := range opts {
+		opt(memory)
 	}
+
+	// pinned messages are honored by every policy
+	memory.Eviction = KeepPinned(memory.Eviction, memory.IsPinned)
+
+	return memory
 }
 
-func (memory *MemoryContext) CurrentWorkingContextSize() int {
-	encoder, err := tiktoken.GetEncoding("cl100k_base")
+// Queue returns the messages after the primer and the summary.
+func (memory *MemoryContext) Queue() []llms.MessageContent {
+	return memory.Messages[memory.headSize:]
+}
+
+// SetQueue replaces the messages after the primer and the summary.
+func (memory *MemoryContext) SetQueue(msgs []llms.MessageContent) {
+	head := memory.Messages[:memory.headSize:memory.headSize]
+	memory.Messages = append(head, msgs...)
+}
+
+// SetHead replaces the system messages at the head of the FIFO queue.
+func (memory *MemoryContext) SetHead(head ...llms.MessageContent) {
+	memory.Messages = append(head, memory.Queue()...)
+	memory.headSize = len(head)
+}
+
+// Evict splits the queue using the eviction policy, the primer
+// and the summary are never evicted.
+func (memory *MemoryContext) Evict() (evicted []llms.MessageContent, kept []llms.MessageContent) {
+	msgs := memory.Queue()
+	kept = []llms.MessageContent{}
+
+	mask := memory.Eviction.Evict(msgs)
+	for i, msg := range msgs {
+		if mask[i] {
+			evicted = append(evicted, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+
+	return evicted, kept
+}
+
+// Pin marks the message so it survives eviction and persists the pin.
+func (memory *MemoryContext) Pin(msg llms.MessageContent) error {
+	encoder, err := getEncoder()
+	if err != nil {
+		memory.logger.Error("creating tiktoken encoder", "error", err)
+		return err
+	}
+
+	if memory.CurrentPinnedSize()+messageTokens(encoder, msg) > int(memory.msgsSize*maxPinnedSize) {
+		return errors.New("pinned messages overflow: unpin messages before pinning new ones")
+	}
+
+	err = memory.Storage.PinMessage(msg, true)
 	if err != nil {
-		log.Printf("Error creating tiktoken encoder: %v", err)
+		return err
+	}
+
+	memory.pinned[messageKey(msg)] = struct{}{}
+
+	return nil
+}
+
+// Unpin releases the message so it can be evicted again.
+func (memory *MemoryContext) Unpin(msg llms.MessageContent) error {
+	err := memory.Storage.PinMessage(msg, false)
+	if err != nil {
+		return err
+	}
+
+	delete(memory.pinned, messageKey(msg))
+
+	return nil
+}
+
+func (memory *MemoryContext) IsPinned(msg llms.MessageContent) bool {
+	_, ok := memory.pinned[messageKey(msg)]
+	return ok
+}
+
+// PinnedMessages returns the pinned messages currently in the FIFO queue.
+func (memory *MemoryContext) PinnedMessages() []llms.MessageContent {
+	msgs := []llms.MessageContent{}
+	for _, msg := range memory.Queue() {
+		if memory.IsPinned(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs
+}
+
+// FindMessage returns the most recent text message in the FIFO queue
+// containing the given text, function calls and responses are skipped.
+func (memory *MemoryContext) FindMessage(text string) (llms.MessageContent, error) {
+	msgs := memory.Queue()
+	for i := len(msgs) - 1; i >= 0; i-- {
+		msg := msgs[i]
+		if msg.Role == llms.ChatMessageTypeTool || hasToolCalls(msg) {
+			continue
+		}
+
+		if strings.Contains(combineAllTextParts(msg.Parts), text) {
+			return msg, nil
+		}
+	}
+
+	return llms.MessageContent{}, fmt.Errorf("no message containing %q found in short term memory", text)
+}
+
+func (memory *MemoryContext) CurrentPinnedSize() int {
+	encoder, err := getEncoder()
+	if err != nil {
+		memory.logger.Error("creating tiktoken encoder", "error", err)
 		return 0
 	}
 
-	return len(encoder.Encode(memory.WorkingContext, nil, nil))
+	totalTokens := 0
+	for _, msg := range memory.PinnedMessages() {
+		totalTokens += messageTokens(encoder, msg)
+	}
+
+	return totalTokens
+}
+
+func (memory *MemoryContext) CurrentWorkingContextSize() int {
+	return memory.countTokens(memory.WorkingContext)
+}
+
+func (memory *MemoryContext) CurrentSummarySize() int {
+	return memory.countTokens(memory.Summary)
 }
 
 func (memory *MemoryContext) CurrentMessagesSize() int {
+	encoder, err := getEncoder()
+	if err != nil {
+		memory.logger.Error("creating tiktoken encoder", "error", err)
+		return 0
+	}
+
+	// the primer and the summary have their own budgets
 	totalTokens := 0
+	for _, msg := range memory.Queue() {
+		totalTokens += messageTokens(encoder, msg)
+	}
+
+	// The chat format typically has an extra 2 tokens at the end
+	totalTokens += 2
+
+	return totalTokens
+}
+
+var (
+	encoderMu     sync.Mutex
+	cachedEncoder *tiktoken.Tiktoken
+)
+
+// getEncoder builds the encoder once, building it parses the whole
+// vocabulary, failed loads are retried on the next call
+func getEncoder() (*tiktoken.Tiktoken, error) {
+	encoderMu.Lock()
+	defer encoderMu.Unlock()
+
+	if cachedEncoder != nil {
+		return cachedEncoder, nil
+	}
+
 	encoder, err := tiktoken.GetEncoding("cl100k_base")
 	if err != nil {
-		log.Printf("Error creating tiktoken encoder: %v", err)
+		return nil, err
+	}
+
+	cachedEncoder = encoder
+
+	return cachedEncoder, nil
+}
+
+func (memory *MemoryContext) countTokens(text string) int {
+	encoder, err := getEncoder()
+	if err != nil {
+		memory.logger.Error("creating tiktoken encoder", "error", err)
 		return 0
 	}
 
-	combineAllTextParts := func(parts []llms.ContentPart) string {
-		result := ""
-		for _, part := range parts {
-			switch v := part.(type) {
-			case llms.TextContent:
-				result += v.String()
-			case llms.ToolCall:
-				txt := fmt.Sprintf("%s %v", v.FunctionCall.Name, v.FunctionCall.Arguments)
-				result += txt
-			default:
-				// ignore or handle other types
-			}
-		}
-		return result
+	return len(encoder.Encode(text, nil, nil))
+}
+
+// MessageTokens counts the tokens of a message the way the queue budget does.
+func (memory *MemoryContext) MessageTokens(msg llms.MessageContent) int {
+	encoder, err := getEncoder()
+	if err != nil {
+		memory.logger.Error("creating tiktoken encoder", "error", err)
+		return 0
 	}
 
-	for _, msg := range memory.Messages {
-		contentToEncode := fmt.Sprintf("%s: %s", msg.Role, combineAllTextParts(msg.Parts))
-		tokenIDs := encoder.Encode(contentToEncode, nil, nil)
-		totalTokens += len(tokenIDs)
+	return messageTokens(encoder, msg)
+}
+
+func messageTokens(encoder *tiktoken.Tiktoken, msg llms.MessageContent) int {
+	contentToEncode := fmt.Sprintf("%s: %s", msg.Role, combineAllTextParts(msg.Parts))
+	return len(encoder.Encode(contentToEncode, nil, nil))
+}
+
+func messageKey(msg llms.MessageContent) string {
+	return string(msg.Role) + combineAllTextParts(msg.Parts)
+}
+
+func hasToolCalls(msg llms.MessageContent) bool {
+	for _, part := range msg.Parts {
+		if _, ok := part.(llms.ToolCall); ok {
+			return true
+		}
 	}
 
-	// The chat format typically has an extra 2 tokens at the end
-	totalTokens += 2
+	return false
+}
 
-	return totalTokens
+func combineAllTextParts(parts []llms.ContentPart) string {
+	result := ""
+	for _, part := range parts {
+		switch v := part.(type) {
+		case llms.TextContent:
+			result += v.String()
+		case llms.ToolCall:
+			txt := fmt.Sprintf("%s %v", v.FunctionCall.Name, v.FunctionCall.Arguments)
+			result += txt
+		case llms.ToolCallResponse:
+			result += v.Content
+		default:
+			// ignore or handle other types
+		}
+	}
+	return result
 }
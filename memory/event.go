@@ -0,0 +1,50 @@
+package memory
+
+import (
+	"encoding/json"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ChatMessageTypeEvent is the role of external events in the message
+// history, events are sent to the llm as system messages but keep
+// their own role in storage so they can be filtered in recall.
+const ChatMessageTypeEvent llms.ChatMessageType = "event"
+
+// Event is a structured non-chat event (user logged in, webhook,
+// file changed etc.) injected into the processor. Applications can
+// define new event types by registering a template for them.
+type Event struct {
+	Type    string
+	Payload map[string]any
+}
+
+const (
+	EventUserLogin   = "user_login"
+	EventWebhook     = "webhook"
+	EventFileChanged = "file_changed"
+)
+
+func (event Event) payloadJSON() string {
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return ""
+	}
+
+	return string(payload)
+}
+
+// llmMessages converts event messages to system messages,
+// providers reject roles they don't know.
+func llmMessages(msgs []llms.MessageContent) []llms.MessageContent {
+	result := make([]llms.MessageContent, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Role == ChatMessageTypeEvent {
+			msg.Role = llms.ChatMessageTypeSystem
+		}
+
+		result = append(result, msg)
+	}
+
+	return result
+}
@@ -0,0 +1,186 @@
+package memory
+
+import (
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// EvictionPolicy decides which messages are moved from the FIFO queue
+// into long term memory when the queue is flushed.
+type EvictionPolicy interface {
+	// Evict receives the FIFO queue (without the primer message) and
+	// returns a mask of the same length, true marks a message for eviction.
+	Evict(msgs []llms.MessageContent) []bool
+
+	// Describe explains the policy to the model, it is rendered
+	// into the Memorize function description.
+	Describe() string
+}
+
+// KeepLastN evicts everything except the n most recent messages.
+func KeepLastN(n int) EvictionPolicy {
+	return keepLastN{n: n}
+}
+
+type keepLastN struct {
+	n int
+}
+
+func (policy keepLastN) Evict(msgs []llms.MessageContent) []bool {
+	evict := make([]bool, len(msgs))
+	for i := 0; i < len(msgs)-policy.n; i++ {
+		evict[i] = true
+	}
+
+	return evict
+}
+
+func (policy keepLastN) Describe() string {
+	return fmt.Sprintf("all messages except the last %d are evicted", policy.n)
+}
+
+// KeepLastTokens evicts the oldest messages until the remaining
+// messages fit into the given number of tokens.
+func KeepLastTokens(tokens int) EvictionPolicy {
+	return keepLastTokens{tokens: tokens}
+}
+
+type keepLastTokens struct {
+	tokens int
+}
+
+func (policy keepLastTokens) Evict(msgs []llms.MessageContent) []bool {
+	evict := make([]bool, len(msgs))
+
+	// nothing is evicted without an encoder, the
+	// failure is logged when the context is measured
+	encoder, err := getEncoder()
+	if err != nil {
+		return evict
+	}
+
+	total := 0
+	for i := len(msgs) - 1; i >= 0; i-- {
+		total += messageTokens(encoder, msgs[i])
+		if total > policy.tokens {
+			for j := 0; j <= i; j++ {
+				evict[j] = true
+			}
+			break
+		}
+	}
+
+	return evict
+}
+
+func (policy keepLastTokens) Describe() string {
+	return fmt.Sprintf("the oldest messages are evicted until the remaining messages fit into %d tokens", policy.tokens)
+}
+
+// EvictOldestFraction evicts the oldest fraction of the messages,
+// MemGPT evicts 50% of the queue on each flush.
+func EvictOldestFraction(fraction float32) EvictionPolicy {
+	return evictOldestFraction{fraction: fraction}
+}
+
+type evictOldestFraction struct {
+	fraction float32
+}
+
+func (policy evictOldestFraction) Evict(msgs []llms.MessageContent) []bool {
+	evict := make([]bool, len(msgs))
+	for i := 0; i < int(float32(len(msgs))*policy.fraction); i++ {
+		evict[i] = true
+	}
+
+	return evict
+}
+
+func (policy evictOldestFraction) Describe() string {
+	return fmt.Sprintf("the oldest %.0f%% of messages are evicted", policy.fraction*100)
+}
+
+// KeepToolPairs wraps a policy so a tool call and its tool responses
+// are never split, if any message of the pair is kept all of them are kept.
+func KeepToolPairs(policy EvictionPolicy) EvictionPolicy {
+	return keepToolPairs{policy: policy}
+}
+
+type keepToolPairs struct {
+	policy EvictionPolicy
+}
+
+func (pairs keepToolPairs) Evict(msgs []llms.MessageContent) []bool {
+	evict := pairs.policy.Evict(msgs)
+
+	// group messages by the tool call ids they contain
+	groups := map[string][]int{}
+	for i, msg := range msgs {
+		for _, part := range msg.Parts {
+			switch v := part.(type) {
+			case llms.ToolCall:
+				groups[v.ID] = append(groups[v.ID], i)
+			case llms.ToolCallResponse:
+				groups[v.ToolCallID] = append(groups[v.ToolCallID], i)
+			}
+		}
+	}
+
+	// keeping one message can pull in another group sharing the
+	// same ai message, so repeat until nothing changes
+	changed := true
+	for changed {
+		changed = false
+		for _, group := range groups {
+			kept := false
+			for _, i := range group {
+				if !evict[i] {
+					kept = true
+				}
+			}
+
+			if !kept {
+				continue
+			}
+
+			for _, i := range group {
+				if evict[i] {
+					evict[i] = false
+					changed = true
+				}
+			}
+		}
+	}
+
+	return evict
+}
+
+func (pairs keepToolPairs) Describe() string {
+	return pairs.policy.Describe() + ", function calls are never separated from their responses"
+}
+
+// KeepPinned wraps a policy so pinned messages are never evicted.
+func KeepPinned(policy EvictionPolicy, pinned func(llms.MessageContent) bool) EvictionPolicy {
+	return keepPinned{policy: policy, pinned: pinned}
+}
+
+type keepPinned struct {
+	policy EvictionPolicy
+	pinned func(llms.MessageContent) bool
+}
+
+func (pins keepPinned) Evict(msgs []llms.MessageContent) []bool {
+	evict := pins.policy.Evict(msgs)
+	for i, msg := range msgs {
+		if pins.pinned(msg) {
+			evict[i] = false
+		}
+	}
+
+	return evict
+}
+
+func (pins keepPinned) Describe() string {
+	return pins.policy.Describe() + ", pinned messages are always kept"
+}
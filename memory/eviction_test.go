@@ -0,0 +1,187 @@
+package memory_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/memory/memorytest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// conversation returns n alternating user and ai messages
+func conversation(n int) []llms.MessageContent {
+	msgs := []llms.MessageContent{}
+	for i := 0; i < n; i++ {
+		role := llms.ChatMessageTypeHuman
+		if i%2 == 1 {
+			role = llms.ChatMessageTypeAI
+		}
+
+		msgs = append(msgs, llms.TextParts(role, fmt.Sprintf("Message %d about the trip to Rome.", i)))
+	}
+
+	return msgs
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	msgs := conversation(5)
+
+	// the last two messages take up this many tokens
+	mainContext := memory.NewMemoryContext(openStorage(t, dbPath(t)))
+	lastTwo := mainContext.MessageTokens(msgs[3]) + mainContext.MessageTokens(msgs[4])
+
+	for _, tc := range []struct {
+		name   string
+		policy memory.EvictionPolicy
+		want   []bool
+	}{
+		{"keep last 2", memory.KeepLastN(2), []bool{true, true, true, false, false}},
+		{"keep more than the queue", memory.KeepLastN(10), []bool{false, false, false, false, false}},
+		{"keep last tokens", memory.KeepLastTokens(lastTwo), []bool{true, true, true, false, false}},
+		{"keep no tokens", memory.KeepLastTokens(0), []bool{true, true, true, true, true}},
+		{"evict half", memory.EvictOldestFraction(0.5), []bool{true, true, false, false, false}},
+		{"evict all", memory.EvictOldestFraction(1), []bool{true, true, true, true, true}},
+	} {
+		if evict := tc.policy.Evict(msgs); !reflect.DeepEqual(evict, tc.want) {
+			t.Errorf("%s: evict = %v, want %v", tc.name, evict, tc.want)
+		}
+	}
+}
+
+func TestKeepToolPairs(t *testing.T) {
+	call := llms.TextParts(llms.ChatMessageTypeAI, "preforming function calls")
+	call.Parts = append(call.Parts, llms.ToolCall{
+		ID:           "call-1",
+		Type:         "function",
+		FunctionCall: &llms.FunctionCall{Name: "Recall", Arguments: `{"search":"Rome"}`},
+	})
+
+	response := llms.MessageContent{
+		Role: llms.ChatMessageTypeTool,
+		Parts: []llms.ContentPart{
+			llms.ToolCallResponse{ToolCallID: "call-1", Name: "Recall", Content: "No messages found."},
+		},
+	}
+
+	msgs := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "What did I say about Rome?"),
+		call,
+		response,
+		llms.TextParts(llms.ChatMessageTypeAI, "Nothing yet."),
+	}
+
+	// the response is kept, so the call that produced it is kept too
+	policy := memory.KeepToolPairs(memory.KeepLastN(2))
+	if evict := policy.Evict(msgs); !reflect.DeepEqual(evict, []bool{true, false, false, false}) {
+		t.Errorf("evict = %v, want only the user message", evict)
+	}
+
+	// a pair that is evicted as a whole stays evicted
+	policy = memory.KeepToolPairs(memory.KeepLastN(1))
+	if evict := policy.Evict(msgs); !reflect.DeepEqual(evict, []bool{true, true, true, false}) {
+		t.Errorf("evict = %v, want everything but the last reply", evict)
+	}
+}
+
+func TestKeepPinned(t *testing.T) {
+	msgs := conversation(4)
+
+	policy := memory.KeepPinned(memory.EvictOldestFraction(1), func(msg llms.MessageContent) bool {
+		return memorytest.MessageText(msg) == memorytest.MessageText(msgs[1])
+	})
+
+	if evict := policy.Evict(msgs); !reflect.DeepEqual(evict, []bool{true, false, true, true}) {
+		t.Errorf("evict = %v, want all but the pinned message", evict)
+	}
+}
+
+func TestMemorizeSavedQueue(t *testing.T) {
+	summarizer := memorytest.NewModel(
+		memorytest.Text("Ana is planning a trip to Rome."),
+	)
+
+	h := newHarness(t, dbPath(t), memorytest.NewModel(), nil,
+		memory.WithSummarizer(summarizer),
+	)
+
+	for _, msg := range conversation(6) {
+		if err := h.processor.System.AppendMessage(msg); err != nil {
+			t.Fatalf("appending message: %v", err)
+		}
+	}
+
+	h.start()
+
+	var saveErr, memorizeErr, resetErr error
+
+	// the queue is already saved when the flush runs
+	h.processor.Do(func(ctx context.Context) {
+		operator := h.processor.Operator()
+		saveErr = operator.Save()
+		memorizeErr = operator.Memorize(ctx)
+		resetErr = operator.Reset()
+	})
+
+	h.stop()
+	h.checkModel(summarizer)
+
+	for name, err := range map[string]error{"save": saveErr, "memorize": memorizeErr, "reset": resetErr} {
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	stats, err := h.storage.MessageStats()
+	if err != nil || stats.Archived != 6 {
+		t.Errorf("archived messages = %d, %v, want 6", stats.Archived, err)
+	}
+}
+
+func TestSaveRepeatedMessages(t *testing.T) {
+	path := dbPath(t)
+	db := openStorage(t, path)
+
+	ok := llms.TextParts(llms.ChatMessageTypeHuman, "ok")
+	noted := llms.TextParts(llms.ChatMessageTypeAI, "Noted.")
+
+	queued := func(want int) {
+		t.Helper()
+
+		// a restart reloads the queue from storage
+		msgs, err := openStorage(t, path).LoadMessages()
+		if err != nil || len(msgs) != want {
+			t.Errorf("loaded %d messages, %v, want %d", len(msgs), err, want)
+		}
+	}
+
+	if err := db.SaveMessages([]llms.MessageContent{ok, noted, ok, noted}); err != nil {
+		t.Fatalf("saving messages: %v", err)
+	}
+
+	queued(4)
+
+	if err := db.ArchiveMessages([]llms.MessageContent{ok, noted}); err != nil {
+		t.Fatalf("archiving messages: %v", err)
+	}
+
+	queued(2)
+
+	// the same message again after the archived one
+	if err := db.SaveMessages([]llms.MessageContent{ok, noted, ok}); err != nil {
+		t.Fatalf("saving messages: %v", err)
+	}
+
+	queued(3)
+
+	if err := db.ArchiveMessages([]llms.MessageContent{ok, noted, ok}); err != nil {
+		t.Fatalf("archiving messages: %v", err)
+	}
+
+	stats, err := db.MessageStats()
+	if err != nil || stats.Archived != 5 {
+		t.Errorf("archived messages = %d, %v, want 5", stats.Archived, err)
+	}
+}
@@ -1,9 +1,15 @@
 package memory
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log/slog"
 
 	"github.com/tmc/langchaingo/llms"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var functions = []llms.Tool{
@@ -27,23 +33,15 @@ var functions = []llms.Tool{
 		Type: "function",
 		Function: &llms.FunctionDefinition{
 			Name:        "Memorize",
-			Description: "Memorize will save the current messages into your long term memory, clear the messages from your short term memory leaving the last 3 messages, and updated the short term memory working context with the summary of evicted messages.",
-			Parameters: map[string]any{
-				"type": "object",
-				"properties": map[string]any{
-					"summary": map[string]any{
-						"type":          "string",
-						"descriptionhj": "Summary of all the messages in your current short term memory.",
-					},
-				},
-			},
+			Description: "Memorize will save the current messages into your long term memory, evict messages from your short term memory according to the eviction policy, and fold the evicted messages into the recursive summary at the head of your messages.",
+			Parameters:  map[string]any{},
 		},
 	},
 	{
 		Type: "function",
 		Function: &llms.FunctionDefinition{
 			Name:        "Reflect",
-			Description: "Reflect will save and summarize vital information from the messages in your short term memory or recovered from long term memory and save it into your short term memory working context.",
+			Description: "Reflect will save and summarize vital information from the messages in your short term memory or recovered from long term memory and save it into your short term memory working context. Summaries exceeding the working context budget are shortened by the system.",
 			Parameters: map[string]any{
 				"type": "object",
 				"properties": map[string]any{
@@ -67,15 +65,168 @@ var functions = []llms.Tool{
 						"type":        "string",
 						"description": "Query to search for previous conversations.",
 					},
+					"roles": map[string]any{
+						"type":        "array",
+						"items":       map[string]any{"type": "string", "enum": []string{"human", "ai", "system", "tool", "event"}},
+						"description": "Message roles to search, defaults to human and ai. External events (user logged in, webhooks, file changes etc.) have the event role.",
+					},
+					"tags": map[string]any{
+						"type":        "array",
+						"items":       map[string]any{"type": "string"},
+						"description": "Tags the recalled messages must have, set with the Tag function.",
+					},
 					"limit": map[string]any{
 						"type":        "number",
 						"description": "Number of messages to recall per page.",
 					},
 					"page": map[string]any{
 						"type":        "number",
-						"description": "Page number to recall.",
+						"description": "Page number to recall, starting at 1.",
+					},
+				},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: &llms.FunctionDefinition{
+			Name:        "conversation_search_date",
+			Description: "conversation_search_date will fetch your previous conversations with the user within a date range and load them into a single message added to your short term context, use it to answer questions like \"what did we discuss last Tuesday?\".",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"start": map[string]any{
+						"type":        "string",
+						"description": "Start of the date range, formatted as YYYY-MM-DD or RFC3339.",
+					},
+					"end": map[string]any{
+						"type":        "string",
+						"description": "End of the date range (inclusive), formatted as YYYY-MM-DD or RFC3339.",
+					},
+					"page": map[string]any{
+						"type":        "number",
+						"description": "Page number to recall, starting at 1.",
+					},
+				},
+				"required": []string{"start", "end"},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: &llms.FunctionDefinition{
+			Name:        "archival_memory_insert",
+			Description: "archival_memory_insert will store facts or documents in your archival memory, archival memory is separate from your conversation history and is not searched by Recall. Use it for information you want to remember indefinitely.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"content": map[string]any{
+						"type":        "string",
+						"description": "Content to store in archival memory, phrase it so it can be found later.",
+					},
+					"tags": map[string]any{
+						"type":        "array",
+						"items":       map[string]any{"type": "string"},
+						"description": "Optional tags describing the content.",
+					},
+				},
+				"required": []string{"content"},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: &llms.FunctionDefinition{
+			Name:        "archival_memory_search",
+			Description: "archival_memory_search will search your archival memory, including documents ingested by the user, results are paginated and the response tells you how many pages there are. Results from ingested documents cite their source file and chunk.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{
+						"type":        "string",
+						"description": "Query to search for in archival memory.",
+					},
+					"page": map[string]any{
+						"type":        "number",
+						"description": "Page number to return, starting at 1.",
+					},
+				},
+				"required": []string{"query"},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: &llms.FunctionDefinition{
+			Name:        "Pin",
+			Description: "Pin will keep a message in your short term memory so it is never evicted to long term memory, use it for vital messages like the user's task description. Pinned messages are listed in your system instructions.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"message": map[string]any{
+						"type":        "string",
+						"description": "Text contained in the message to pin, the most recent message containing the text is pinned.",
+					},
+				},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: &llms.FunctionDefinition{
+			Name:        "Unpin",
+			Description: "Unpin will release a pinned message so it can be evicted to long term memory.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"message": map[string]any{
+						"type":        "string",
+						"description": "Text contained in the pinned message to release.",
+					},
+				},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: &llms.FunctionDefinition{
+			Name:        "Tag",
+			Description: "Tag will label a message in your short term memory, e.g. with a project or topic, so you can find it with the Recall function once it was moved to long term memory.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"message": map[string]any{
+						"type":        "string",
+						"description": "Text contained in the message to tag, the most recent message containing the text is tagged.",
+					},
+					"tags": map[string]any{
+						"type":        "array",
+						"items":       map[string]any{"type": "string"},
+						"description": "Tags to add to the message.",
 					},
 				},
+				"required": []string{"message", "tags"},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: &llms.FunctionDefinition{
+			Name:        "ScheduleReminder",
+			Description: "ScheduleReminder will wake you up at the given time with a system message containing your note, use it to follow up on tasks later. Reminders survive restarts.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"at": map[string]any{
+						"type":        "string",
+						"description": "When to wake up, formatted as RFC3339, YYYY-MM-DD HH:MM or a duration from now like 30m or 2h.",
+					},
+					"note": map[string]any{
+						"type":        "string",
+						"description": "Note to your future self explaining why you should wake up.",
+					},
+				},
+				"required": []string{"at", "note"},
 			},
 		},
 	},
@@ -134,17 +285,92 @@ var functions = []llms.Tool{
 type Executor struct {
 	operator  MemoryOperator
 	functions []llms.Tool
+	logger    *slog.Logger
+	tracer    trace.Tracer
+
+	// storage operations of a function are linked to its span
+	storage *tracedStorage
 }
 
-func NewExecutor(mainContext *MemoryContext) Executor {
+func NewExecutor(mainContext *MemoryContext, summarizer *Summarizer, scheduler *Scheduler) Executor {
 	return Executor{
-		operator:  *NewMemoryOperator(mainContext),
-		functions: functions,
+		operator:  *NewMemoryOperator(mainContext, summarizer, scheduler),
+		functions: describeFunctions(mainContext),
+		logger:    NopLogger(),
+		tracer:    otel.GetTracerProvider().Tracer(tracerName),
+	}
+}
+
+var heartbeatParameter = map[string]any{
+	"type":        "boolean",
+	"description": "Request an immediate heartbeat after function execution. Set to true if you want to run a follow-up function or send a follow-up message, otherwise the function cycle ends.",
+}
+
+// describeFunctions copies the function definitions, renders the memory
+// context configuration into their descriptions and adds the
+// request_heartbeat parameter to every function
+func describeFunctions(mainContext *MemoryContext) []llms.Tool {
+	tools := make([]llms.Tool, 0, len(functions))
+
+	for _, tool := range functions {
+		definition := *tool.Function
+
+		if definition.Name == "Memorize" {
+			definition.Description += " Eviction policy: " + mainContext.Eviction.Describe() + "."
+		}
+
+		definition.Parameters = withHeartbeat(definition.Parameters)
+		tool.Function = &definition
+
+		tools = append(tools, tool)
 	}
+
+	return tools
+}
+
+func withHeartbeat(parameters any) map[string]any {
+	params := map[string]any{}
+	properties := map[string]any{}
+
+	if original, ok := parameters.(map[string]any); ok {
+		for key, value := range original {
+			params[key] = value
+		}
+
+		if originalProperties, ok := original["properties"].(map[string]any); ok {
+			for key, value := range originalProperties {
+				properties[key] = value
+			}
+		}
+	}
+
+	properties["request_heartbeat"] = heartbeatParameter
+	params["type"] = "object"
+	params["properties"] = properties
+
+	return params
 }
 
 // Run the llm functions
-func (executor *Executor) Run(fn llms.ToolCall) (string, error) {
+func (executor *Executor) Run(ctx context.Context, fn llms.ToolCall) (string, error) {
+	executor.logger.Debug("running function", "function", fn.FunctionCall.Name, "id", fn.ID, "arguments", fn.FunctionCall.Arguments)
+
+	ctx, span := executor.tracer.Start(ctx, "execute_tool "+fn.FunctionCall.Name, trace.WithAttributes(
+		attribute.String("gen_ai.operation.name", "execute_tool"),
+		attribute.String("gen_ai.tool.name", fn.FunctionCall.Name),
+		attribute.String("gen_ai.tool.call.id", fn.ID),
+	))
+
+	restore := executor.storage.withParent(ctx)
+	defer restore()
+
+	result, err := executor.run(ctx, fn)
+	endSpan(span, err)
+
+	return result, err
+}
+
+func (executor *Executor) run(ctx context.Context, fn llms.ToolCall) (string, error) {
 	switch fn.FunctionCall.Name {
 	case "Load":
 		err := executor.operator.Load()
@@ -161,52 +387,157 @@ func (executor *Executor) Run(fn llms.ToolCall) (string, error) {
 
 		return "Memory context saved", nil
 	case "Memorize":
+		err := executor.operator.Memorize(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		return "Memory context memorized", nil
+	case "Reflect":
 		var args struct {
 			Summary string `json:"summary"`
 		}
 
 		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
-			return "Error unmarshalling Memorize arguments", err
+			return "Error unmarshalling Reflect arguments", err
 		}
 
-		err := executor.operator.Memorize(args.Summary)
+		err := executor.operator.Reflect(ctx, args.Summary)
 		if err != nil {
 			return "", err
 		}
 
-		return "Memory context memorized", nil
-	case "Reflect":
+		return "Memory context reflected", nil
+	case "Recall":
 		var args struct {
-			Summary string `json:"summary"`
+			Search string   `json:"search"`
+			Roles  []string `json:"roles"`
+			Tags   []string `json:"tags"`
+			Limit  int      `json:"limit"`
+			Page   int      `json:"page"`
 		}
 
 		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
-			return "Error unmarshalling Reflect arguments", err
+			return "Error unmarshalling Recall arguments", err
 		}
 
-		err := executor.operator.Reflect(args.Summary)
+		query := RecallQuery{
+			Search: args.Search,
+			Tags:   args.Tags,
+			Limit:  args.Limit,
+		}
+
+		for _, role := range args.Roles {
+			query.Roles = append(query.Roles, llms.ChatMessageType(role))
+		}
+
+		return executor.operator.Recall(query, args.Page)
+	case "conversation_search_date":
+		var args struct {
+			Start string `json:"start"`
+			End   string `json:"end"`
+			Page  int    `json:"page"`
+		}
+
+		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
+			return "Error unmarshalling conversation_search_date arguments", err
+		}
+
+		start, err := parseRecallDate(args.Start, false)
 		if err != nil {
 			return "", err
 		}
 
-		return "Memory context reflected", nil
-	case "Recall":
+		end, err := parseRecallDate(args.End, true)
+		if err != nil {
+			return "", err
+		}
+
+		return executor.operator.Recall(RecallQuery{Start: start, End: end}, args.Page)
+	case "archival_memory_insert":
+		var args struct {
+			Content string   `json:"content"`
+			Tags    []string `json:"tags"`
+		}
+
+		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
+			return "Error unmarshalling archival_memory_insert arguments", err
+		}
+
+		err := executor.operator.ArchivalInsert(ctx, args.Content, args.Tags)
+		if err != nil {
+			return "", err
+		}
+
+		return "Content stored in archival memory", nil
+	case "archival_memory_search":
 		var args struct {
 			Query string `json:"query"`
-			Limit int    `json:"limit"`
 			Page  int    `json:"page"`
 		}
 
 		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
-			return "Error unmarshalling Recall arguments", err
+			return "Error unmarshalling archival_memory_search arguments", err
 		}
 
-		err := executor.operator.Recall(args.Query, args.Limit, args.Page)
+		return executor.operator.ArchivalSearch(ctx, args.Query, args.Page)
+	case "Pin":
+		var args struct {
+			Message string `json:"message"`
+		}
+
+		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
+			return "Error unmarshalling Pin arguments", err
+		}
+
+		err := executor.operator.Pin(args.Message)
 		if err != nil {
 			return "", err
 		}
 
-		return "Conversation history recalled", nil
+		return "Message pinned", nil
+	case "Unpin":
+		var args struct {
+			Message string `json:"message"`
+		}
+
+		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
+			return "Error unmarshalling Unpin arguments", err
+		}
+
+		err := executor.operator.Unpin(args.Message)
+		if err != nil {
+			return "", err
+		}
+
+		return "Message unpinned", nil
+	case "Tag":
+		var args struct {
+			Message string   `json:"message"`
+			Tags    []string `json:"tags"`
+		}
+
+		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
+			return "Error unmarshalling Tag arguments", err
+		}
+
+		err := executor.operator.Tag(args.Message, args.Tags)
+		if err != nil {
+			return "", err
+		}
+
+		return "Message tagged", nil
+	case "ScheduleReminder":
+		var args struct {
+			At   string `json:"at"`
+			Note string `json:"note"`
+		}
+
+		if err := json.Unmarshal([]byte(fn.FunctionCall.Arguments), &args); err != nil {
+			return "Error unmarshalling ScheduleReminder arguments", err
+		}
+
+		return executor.operator.ScheduleReminder(args.At, args.Note)
 	case "Think":
 		var args struct {
 			Thought string `json:"thought"`
@@ -239,5 +570,5 @@ func (executor *Executor) Run(fn llms.ToolCall) (string, error) {
 		return executor.operator.ExternalOutput(args.FinalOutput), nil
 	}
 
-	return "", nil
+	return "", fmt.Errorf("unknown function: %s", fn.FunctionCall.Name)
 }
@@ -0,0 +1,193 @@
+package memory
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tmc/langchaingo/documentloaders"
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/textsplitter"
+)
+
+var (
+	defaultChunkSize    = 512
+	defaultChunkOverlap = 100
+)
+
+// Ingestor loads documents (runbooks, specs etc.) into archival memory,
+// documents are split into overlapping chunks, tagged with their
+// source and embedded when an embedder is configured.
+type Ingestor struct {
+	storage      MemoryStorage
+	embedder     embeddings.Embedder
+	chunkSize    int
+	chunkOverlap int
+}
+
+type IngestOption func(*Ingestor)
+
+func WithChunkSize(size int) IngestOption {
+	return func(ingestor *Ingestor) {
+		ingestor.chunkSize = size
+	}
+}
+
+func WithChunkOverlap(overlap int) IngestOption {
+	return func(ingestor *Ingestor) {
+		ingestor.chunkOverlap = overlap
+	}
+}
+
+func NewIngestor(storage MemoryStorage, embedder embeddings.Embedder, opts ...IngestOption) *Ingestor {
+	ingestor := &Ingestor{
+		storage:      storage,
+		embedder:     embedder,
+		chunkSize:    defaultChunkSize,
+		chunkOverlap: defaultChunkOverlap,
+	}
+
+	for _, opt := range opts {
+		opt(ingestor)
+	}
+
+	return ingestor
+}
+
+// IngestFile stores the chunks of a txt, markdown, pdf or json lines
+// file in archival memory and returns the number of stored chunks.
+func (ingestor *Ingestor) IngestFile(ctx context.Context, path string, tags ...string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	splitterOpts := []textsplitter.Option{
+		textsplitter.WithChunkSize(ingestor.chunkSize),
+		textsplitter.WithChunkOverlap(ingestor.chunkOverlap),
+	}
+
+	var loader documentloaders.Loader
+	var splitter textsplitter.TextSplitter = textsplitter.NewRecursiveCharacter(splitterOpts...)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".txt", ".text":
+		loader = documentloaders.NewText(file)
+	case ".md", ".markdown":
+		loader = documentloaders.NewText(file)
+		splitter = textsplitter.NewMarkdownTextSplitter(splitterOpts...)
+	case ".pdf":
+		info, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+
+		loader = documentloaders.NewPDF(file, info.Size())
+	case ".jsonl", ".ndjson":
+		loader = jsonLines{r: file}
+	default:
+		return 0, fmt.Errorf("unsupported file type: %s", path)
+	}
+
+	docs, err := loader.LoadAndSplit(ctx, splitter)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(docs) == 0 {
+		return 0, nil
+	}
+
+	var vectors [][]float32
+	if ingestor.embedder != nil {
+		texts := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			texts = append(texts, doc.PageContent)
+		}
+
+		vectors, err = ingestor.embedder.EmbedDocuments(ctx, texts)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	passages := make([]Passage, 0, len(docs))
+	for i, doc := range docs {
+		passage := Passage{
+			Content: doc.PageContent,
+			Tags:    tags,
+			Source:  path,
+			Chunk:   i + 1,
+		}
+
+		if vectors != nil {
+			passage.Embedding = vectors[i]
+		}
+
+		passages = append(passages, passage)
+	}
+
+	err = ingestor.storage.InsertPassages(passages)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(passages), nil
+}
+
+// jsonLines loads a document per line, the text is taken from the
+// "text" or "content" field and falls back to the raw line.
+type jsonLines struct {
+	r io.Reader
+}
+
+func (loader jsonLines) Load(_ context.Context) ([]schema.Document, error) {
+	docs := []schema.Document{}
+
+	scanner := bufio.NewScanner(loader.r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var record map[string]any
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if content, ok := record["text"].(string); ok {
+			text = content
+		} else if content, ok := record["content"].(string); ok {
+			text = content
+		}
+
+		docs = append(docs, schema.Document{
+			PageContent: text,
+			Metadata:    map[string]any{"line": line},
+		})
+	}
+
+	return docs, scanner.Err()
+}
+
+func (loader jsonLines) LoadAndSplit(ctx context.Context, splitter textsplitter.TextSplitter) ([]schema.Document, error) {
+	docs, err := loader.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return textsplitter.SplitDocuments(splitter, docs)
+}
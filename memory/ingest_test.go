@@ -0,0 +1,82 @@
+package memory_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Struki84/GoMemGPT/memory"
+)
+
+// embedder returns a fixed vector for every text
+type embedder struct{}
+
+func (embedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := [][]float32{}
+	for range texts {
+		vectors = append(vectors, []float32{1, 0})
+	}
+
+	return vectors, nil
+}
+
+func (embedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	return []float32{1, 0}, nil
+}
+
+func TestIngestUsage(t *testing.T) {
+	db := openStorage(t, dbPath(t))
+
+	path := filepath.Join(t.TempDir(), "runbook.txt")
+	err := os.WriteFile(path, []byte("Restart the worker before rotating the keys."), 0o644)
+	if err != nil {
+		t.Fatalf("writing document: %v", err)
+	}
+
+	metered := memory.MeteredEmbedder(memory.NamedEmbedder(embedder{}, "test-embedding"), db, memory.NopLogger())
+	chunks, err := memory.NewIngestor(db, metered).IngestFile(context.Background(), path)
+	if err != nil || chunks != 1 {
+		t.Fatalf("ingested %d chunks, %v, want 1", chunks, err)
+	}
+
+	totals, err := db.LoadUsage(memory.UsageQuery{})
+	if err != nil {
+		t.Fatalf("loading usage: %v", err)
+	}
+
+	if len(totals) != 1 {
+		t.Fatalf("usage = %+v, want a single total", totals)
+	}
+
+	total := totals[0]
+	if total.Purpose != memory.UsageEmbedding || total.Model != "test-embedding" || total.Calls != 1 || total.Estimated != 1 || total.PromptTokens == 0 {
+		t.Errorf("usage = %+v, want one estimated embedding call", total)
+	}
+}
+
+func TestIngestWithoutEmbedder(t *testing.T) {
+	db := openStorage(t, dbPath(t))
+
+	path := filepath.Join(t.TempDir(), "runbook.txt")
+	err := os.WriteFile(path, []byte("Restart the worker before rotating the keys."), 0o644)
+	if err != nil {
+		t.Fatalf("writing document: %v", err)
+	}
+
+	// the wrappers keep a missing embedder missing, chunks are stored for text search
+	metered := memory.MeteredEmbedder(memory.NamedEmbedder(nil, "test-embedding"), db, memory.NopLogger())
+	if metered != nil {
+		t.Fatalf("metered embedder = %v, want nil", metered)
+	}
+
+	chunks, err := memory.NewIngestor(db, metered).IngestFile(context.Background(), path)
+	if err != nil || chunks != 1 {
+		t.Fatalf("ingested %d chunks, %v, want 1", chunks, err)
+	}
+
+	passages, _, err := db.SearchPassages(memory.PassageQuery{Search: "rotating the keys", Limit: 10})
+	if err != nil || len(passages) != 1 {
+		t.Errorf("found %d passages, %v, want 1", len(passages), err)
+	}
+}
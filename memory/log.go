@@ -0,0 +1,50 @@
+package memory
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// discardHandler drops every record, the loggers default to it
+// so the package stays silent when it is used as a library
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool   { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error  { return nil }
+func (handler discardHandler) WithAttrs([]slog.Attr) slog.Handler { return handler }
+func (handler discardHandler) WithGroup(string) slog.Handler      { return handler }
+
+// NopLogger returns a logger that discards all records.
+func NopLogger() *slog.Logger {
+	return slog.New(discardHandler{})
+}
+
+// messageAttrs describes a message for the logs, function calls
+// are listed by name instead of their arguments
+func messageAttrs(msg llms.MessageContent) []any {
+	attrs := []any{slog.String("role", string(msg.Role))}
+
+	text := ""
+	functions := []string{}
+
+	for _, part := range msg.Parts {
+		switch v := part.(type) {
+		case llms.TextContent:
+			text += v.Text
+		case llms.ToolCall:
+			functions = append(functions, v.FunctionCall.Name)
+		case llms.ToolCallResponse:
+			attrs = append(attrs, slog.String("function", v.Name))
+			text += v.Content
+		}
+	}
+
+	attrs = append(attrs, slog.String("text", text))
+	if len(functions) > 0 {
+		attrs = append(attrs, slog.Any("functions", functions))
+	}
+
+	return attrs
+}
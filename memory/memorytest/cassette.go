@@ -0,0 +1,380 @@
+package memorytest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Cassette holds the recorded interactions with a model,
+// it is stored as a JSON file.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a single GenerateContent call.
+type Interaction struct {
+	Request  Request          `json:"request"`
+	Response []RecordedChoice `json:"response,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// Request is what the model was called with.
+type Request struct {
+	Messages []llms.MessageContent `json:"messages"`
+	Tools    []llms.Tool           `json:"tools,omitempty"`
+	Options  RequestOptions        `json:"options"`
+}
+
+// RequestOptions are the call options that change the response,
+// streaming functions and metadata are not recorded.
+type RequestOptions struct {
+	Model       string   `json:"model,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+	Temperature float64  `json:"temperature,omitempty"`
+	StopWords   []string `json:"stopWords,omitempty"`
+	JSONMode    bool     `json:"json,omitempty"`
+	ToolChoice  any      `json:"toolChoice,omitempty"`
+}
+
+// RecordedChoice is a response choice, tool calls are stored
+// flat since llms.ToolCall doesn't decode its own JSON.
+type RecordedChoice struct {
+	Content        string             `json:"content"`
+	StopReason     string             `json:"stopReason,omitempty"`
+	GenerationInfo map[string]any     `json:"generationInfo,omitempty"`
+	ToolCalls      []RecordedToolCall `json:"toolCalls,omitempty"`
+}
+
+type RecordedToolCall struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// LoadCassette reads a cassette file.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette := &Cassette{}
+	err = json.Unmarshal(data, cassette)
+	if err != nil {
+		return nil, fmt.Errorf("decoding cassette %s: %w", path, err)
+	}
+
+	return cassette, nil
+}
+
+// Save writes the cassette file.
+func (cassette *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+func newRequest(messages []llms.MessageContent, options []llms.CallOption) Request {
+	opts := llms.CallOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	return Request{
+		Messages: messages,
+		Tools:    opts.Tools,
+		Options: RequestOptions{
+			Model:       opts.Model,
+			MaxTokens:   opts.MaxTokens,
+			Temperature: opts.Temperature,
+			StopWords:   opts.StopWords,
+			JSONMode:    opts.JSONMode,
+			ToolChoice:  opts.ToolChoice,
+		},
+	}
+}
+
+func recordChoices(response *llms.ContentResponse) []RecordedChoice {
+	choices := []RecordedChoice{}
+	for _, choice := range response.Choices {
+		recorded := RecordedChoice{
+			Content:        choice.Content,
+			StopReason:     choice.StopReason,
+			GenerationInfo: choice.GenerationInfo,
+		}
+
+		for _, toolCall := range choice.ToolCalls {
+			recorded.ToolCalls = append(recorded.ToolCalls, RecordedToolCall{
+				ID:        toolCall.ID,
+				Type:      toolCall.Type,
+				Name:      toolCall.FunctionCall.Name,
+				Arguments: toolCall.FunctionCall.Arguments,
+			})
+		}
+
+		choices = append(choices, recorded)
+	}
+
+	return choices
+}
+
+func (interaction Interaction) response() (*llms.ContentResponse, error) {
+	if interaction.Error != "" {
+		return nil, errors.New(interaction.Error)
+	}
+
+	response := &llms.ContentResponse{}
+	for _, recorded := range interaction.Response {
+		choice := &llms.ContentChoice{
+			Content:        recorded.Content,
+			StopReason:     recorded.StopReason,
+			GenerationInfo: recorded.GenerationInfo,
+		}
+
+		for _, toolCall := range recorded.ToolCalls {
+			choice.ToolCalls = append(choice.ToolCalls, llms.ToolCall{
+				ID:   toolCall.ID,
+				Type: toolCall.Type,
+				FunctionCall: &llms.FunctionCall{
+					Name:      toolCall.Name,
+					Arguments: toolCall.Arguments,
+				},
+			})
+		}
+
+		response.Choices = append(response.Choices, choice)
+	}
+
+	return response, nil
+}
+
+// Recorder wraps a model and records every call into a cassette,
+// the file is rewritten after each call so a crashed session is kept.
+type Recorder struct {
+	llm  llms.Model
+	path string
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+func NewRecorder(llm llms.Model, path string) *Recorder {
+	return &Recorder{
+		llm:  llm,
+		path: path,
+	}
+}
+
+func (recorder *Recorder) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	response, err := recorder.llm.GenerateContent(ctx, messages, options...)
+
+	interaction := Interaction{
+		Request: newRequest(messages, options),
+	}
+
+	if err != nil {
+		interaction.Error = err.Error()
+	} else {
+		interaction.Response = recordChoices(response)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	recorder.cassette.Interactions = append(recorder.cassette.Interactions, interaction)
+
+	saveErr := recorder.cassette.Save(recorder.path)
+	if saveErr != nil {
+		return nil, fmt.Errorf("saving cassette: %w", saveErr)
+	}
+
+	return response, err
+}
+
+func (recorder *Recorder) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, recorder, prompt, options...)
+}
+
+// timestamps rendered into the prompts, masked when
+// requests are compared so replays don't drift on time
+var timestampPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(January|February|March|April|May|June|July|August|September|October|November|December) \d{2}, \d{4}, \d{2}:\d{2}:\d{2}`),
+	regexp.MustCompile(`\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}(:\d{2})?`),
+}
+
+// MaskTimestamps replaces the timestamps in the text with a placeholder.
+func MaskTimestamps(text string) string {
+	for _, pattern := range timestampPatterns {
+		text = pattern.ReplaceAllString(text, "<time>")
+	}
+
+	return text
+}
+
+// ErrDrift is returned when a replayed request differs from the recorded one.
+var ErrDrift = errors.New("memorytest: request drifted from cassette")
+
+// Replayer serves the responses of a cassette in order and fails
+// when a request differs from the recorded one.
+type Replayer struct {
+	cassette  *Cassette
+	normalize func(string) string
+
+	mu   sync.Mutex
+	next int
+	errs []error
+}
+
+type ReplayOption func(*Replayer)
+
+// WithNormalizer replaces the function applied to recorded and replayed
+// requests before they are compared, timestamps are masked by default.
+func WithNormalizer(normalize func(string) string) ReplayOption {
+	return func(replayer *Replayer) {
+		replayer.normalize = normalize
+	}
+}
+
+func NewReplayer(cassette *Cassette, opts ...ReplayOption) *Replayer {
+	replayer := &Replayer{
+		cassette:  cassette,
+		normalize: MaskTimestamps,
+	}
+
+	for _, opt := range opts {
+		opt(replayer)
+	}
+
+	return replayer
+}
+
+func (replayer *Replayer) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+
+	call := replayer.next + 1
+
+	if replayer.next >= len(replayer.cassette.Interactions) {
+		err := fmt.Errorf("call %d: %w: cassette has %d interactions", call, ErrDrift, len(replayer.cassette.Interactions))
+		replayer.errs = append(replayer.errs, err)
+		return nil, err
+	}
+
+	interaction := replayer.cassette.Interactions[replayer.next]
+	replayer.next++
+
+	err := replayer.compare(interaction.Request, newRequest(messages, options))
+	if err != nil {
+		err = fmt.Errorf("call %d: %w", call, err)
+		replayer.errs = append(replayer.errs, err)
+		return nil, err
+	}
+
+	return interaction.response()
+}
+
+func (replayer *Replayer) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, replayer, prompt, options...)
+}
+
+// compare reports the first difference between the requests
+func (replayer *Replayer) compare(recorded Request, replayed Request) error {
+	if len(recorded.Messages) != len(replayed.Messages) {
+		return fmt.Errorf("%w: %d messages, recorded %d", ErrDrift, len(replayed.Messages), len(recorded.Messages))
+	}
+
+	for i := range recorded.Messages {
+		want, err := replayer.encode(recorded.Messages[i])
+		if err != nil {
+			return err
+		}
+
+		got, err := replayer.encode(replayed.Messages[i])
+		if err != nil {
+			return err
+		}
+
+		if want != got {
+			return fmt.Errorf("%w: message %d is\n%s\nrecorded\n%s", ErrDrift, i, got, want)
+		}
+	}
+
+	want, err := replayer.encode(recorded.Tools)
+	if err != nil {
+		return err
+	}
+
+	got, err := replayer.encode(replayed.Tools)
+	if err != nil {
+		return err
+	}
+
+	if want != got {
+		return fmt.Errorf("%w: tools changed", ErrDrift)
+	}
+
+	want, err = replayer.encode(recorded.Options)
+	if err != nil {
+		return err
+	}
+
+	got, err = replayer.encode(replayed.Options)
+	if err != nil {
+		return err
+	}
+
+	if want != got {
+		return fmt.Errorf("%w: options are %s, recorded %s", ErrDrift, got, want)
+	}
+
+	return nil
+}
+
+// encode round trips the value through JSON so recorded
+// and live values are compared in the same form
+func (replayer *Replayer) encode(value any) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	var decoded any
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		return "", err
+	}
+
+	data, err = json.Marshal(decoded)
+	if err != nil {
+		return "", err
+	}
+
+	return replayer.normalize(string(data)), nil
+}
+
+// Remaining returns the number of interactions left to replay.
+func (replayer *Replayer) Remaining() int {
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+
+	return len(replayer.cassette.Interactions) - replayer.next
+}
+
+// Err returns the drift errors of the replay.
+func (replayer *Replayer) Err() error {
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+
+	return errors.Join(replayer.errs...)
+}
@@ -0,0 +1,106 @@
+package memorytest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
+)
+
+// Clock is a memory.Clock that only moves when it is advanced,
+// timers fire once the clock reaches them.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+type timer struct {
+	clock  *Clock
+	at     time.Time
+	active bool
+	ch     chan time.Time
+}
+
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (clock *Clock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	return clock.now
+}
+
+func (clock *Clock) NewTimer(d time.Duration) memory.Timer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	timer := &timer{clock: clock, ch: make(chan time.Time, 1)}
+	clock.timers = append(clock.timers, timer)
+	timer.reset(d)
+
+	return timer
+}
+
+// Timers returns the number of timers created on the clock.
+func (clock *Clock) Timers() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	return len(clock.timers)
+}
+
+// Advance moves the clock forward and fires the timers it reached.
+func (clock *Clock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	clock.now = clock.now.Add(d)
+
+	for _, timer := range clock.timers {
+		if timer.active && !timer.at.After(clock.now) {
+			timer.fire()
+		}
+	}
+}
+
+func (timer *timer) C() <-chan time.Time {
+	return timer.ch
+}
+
+func (timer *timer) Reset(d time.Duration) {
+	timer.clock.mu.Lock()
+	defer timer.clock.mu.Unlock()
+
+	timer.reset(d)
+}
+
+func (timer *timer) Stop() {
+	timer.clock.mu.Lock()
+	defer timer.clock.mu.Unlock()
+
+	timer.active = false
+}
+
+// reset is called with the clock locked
+func (timer *timer) reset(d time.Duration) {
+	// drop a tick nobody received
+	select {
+	case <-timer.ch:
+	default:
+	}
+
+	timer.at = timer.clock.now.Add(d)
+	timer.active = true
+
+	if d <= 0 {
+		timer.fire()
+	}
+}
+
+func (timer *timer) fire() {
+	timer.active = false
+	timer.ch <- timer.clock.now
+}
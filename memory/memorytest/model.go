@@ -0,0 +1,257 @@
+// Package memorytest provides a scriptable llms.Model for testing
+// the memory processor without a live model.
+package memorytest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func init() {
+	// count tokens with the embedded encodings, tests don't download them
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// ErrNoResponse is returned when the model is called after
+// all scripted responses were used.
+var ErrNoResponse = errors.New("memorytest: no scripted response left")
+
+// Response is a scripted model response, a text reply,
+// function calls or an error.
+type Response struct {
+	Content        string
+	ToolCalls      []llms.ToolCall
+	GenerationInfo map[string]any
+	Err            error
+
+	// the response has no choices
+	NoChoices bool
+
+	// assertions on the messages the model received
+	expect []func(msgs []llms.MessageContent) error
+}
+
+// Text replies with the content.
+func Text(content string) Response {
+	return Response{Content: content}
+}
+
+// ToolCall replies with a single function call, the arguments
+// are encoded to JSON.
+func ToolCall(name string, args any) Response {
+	return Response{}.ToolCall(name, args)
+}
+
+// Error fails the model call.
+func Error(err error) Response {
+	return Response{Err: err}
+}
+
+// Empty replies without any choices, as some providers do
+// when the content is filtered.
+func Empty() Response {
+	return Response{NoChoices: true}
+}
+
+// ToolCall adds another function call to the response.
+func (response Response) ToolCall(name string, args any) Response {
+	arguments, err := json.Marshal(args)
+	if err != nil {
+		panic(fmt.Sprintf("memorytest: encoding %s arguments: %v", name, err))
+	}
+
+	calls := make([]llms.ToolCall, len(response.ToolCalls), len(response.ToolCalls)+1)
+	copy(calls, response.ToolCalls)
+
+	response.ToolCalls = append(calls, llms.ToolCall{
+		Type: "function",
+		FunctionCall: &llms.FunctionCall{
+			Name:      name,
+			Arguments: string(arguments),
+		},
+	})
+
+	return response
+}
+
+// Expect asserts on the messages the model receives before the response
+// is returned, failed assertions are reported by Model.Err.
+func (response Response) Expect(fn func(msgs []llms.MessageContent) error) Response {
+	expect := make([]func(msgs []llms.MessageContent) error, len(response.expect), len(response.expect)+1)
+	copy(expect, response.expect)
+
+	response.expect = append(expect, fn)
+	return response
+}
+
+// Usage reports the token counts in the generation info, the same
+// keys as the openai client.
+func (response Response) Usage(promptTokens int, completionTokens int) Response {
+	response.GenerationInfo = map[string]any{
+		"PromptTokens":     promptTokens,
+		"CompletionTokens": completionTokens,
+		"TotalTokens":      promptTokens + completionTokens,
+	}
+
+	return response
+}
+
+// Call is a message sent to the model.
+type Call struct {
+	Messages []llms.MessageContent
+	Options  llms.CallOptions
+}
+
+// Model replays the scripted responses in order and records the calls.
+type Model struct {
+	mu        sync.Mutex
+	responses []Response
+	calls     []Call
+	errs      []error
+	toolCalls int
+	called    chan struct{}
+}
+
+func NewModel(responses ...Response) *Model {
+	return &Model{
+		responses: responses,
+		called:    make(chan struct{}, 100),
+	}
+}
+
+// Push appends responses to the script.
+func (model *Model) Push(responses ...Response) {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	model.responses = append(model.responses, responses...)
+}
+
+func (model *Model) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	defer func() {
+		select {
+		case model.called <- struct{}{}:
+		default:
+		}
+	}()
+
+	opts := llms.CallOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	model.calls = append(model.calls, Call{
+		Messages: append([]llms.MessageContent{}, messages...),
+		Options:  opts,
+	})
+
+	if len(model.responses) == 0 {
+		model.errs = append(model.errs, fmt.Errorf("call %d: %w", len(model.calls), ErrNoResponse))
+		return nil, ErrNoResponse
+	}
+
+	response := model.responses[0]
+	model.responses = model.responses[1:]
+
+	for _, expect := range response.expect {
+		if err := expect(messages); err != nil {
+			model.errs = append(model.errs, fmt.Errorf("call %d: %w", len(model.calls), err))
+		}
+	}
+
+	if response.Err != nil {
+		return nil, response.Err
+	}
+
+	if response.NoChoices {
+		return &llms.ContentResponse{}, nil
+	}
+
+	toolCalls := []llms.ToolCall{}
+	for _, toolCall := range response.ToolCalls {
+		model.toolCalls++
+		toolCall.ID = fmt.Sprintf("call_%d", model.toolCalls)
+		toolCalls = append(toolCalls, toolCall)
+	}
+
+	return &llms.ContentResponse{
+		Choices: []*llms.ContentChoice{
+			{
+				Content:        response.Content,
+				ToolCalls:      toolCalls,
+				GenerationInfo: response.GenerationInfo,
+			},
+		},
+	}, nil
+}
+
+func (model *Model) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, model, prompt, options...)
+}
+
+// Calls returns the calls the model received so far.
+func (model *Model) Calls() []Call {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	return append([]Call{}, model.calls...)
+}
+
+// Remaining returns the number of responses left in the script.
+func (model *Model) Remaining() int {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	return len(model.responses)
+}
+
+// Err returns the failed assertions and calls made after the
+// script ran out, joined into a single error.
+func (model *Model) Err() error {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	return errors.Join(model.errs...)
+}
+
+// Called signals each time the model was called.
+func (model *Model) Called() <-chan struct{} {
+	return model.called
+}
+
+// LastMessage returns the last message of a call.
+func (call Call) LastMessage() llms.MessageContent {
+	if len(call.Messages) == 0 {
+		return llms.MessageContent{}
+	}
+
+	return call.Messages[len(call.Messages)-1]
+}
+
+// MessageText returns the text of all the message parts, function
+// calls and responses included.
+func MessageText(msg llms.MessageContent) string {
+	text := ""
+	for _, part := range msg.Parts {
+		switch v := part.(type) {
+		case llms.TextContent:
+			text += v.Text
+		case llms.ToolCall:
+			text += v.FunctionCall.Name + " " + v.FunctionCall.Arguments
+		case llms.ToolCallResponse:
+			text += v.Content
+		}
+	}
+
+	return text
+}
@@ -0,0 +1,199 @@
+package memory
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "gomemgpt"
+
+// metrics are the prometheus collectors of a processor, a nil
+// metrics records nothing so the components don't check for it
+type metrics struct {
+	turns         *prometheus.CounterVec
+	llmDuration   *prometheus.HistogramVec
+	toolCalls     *prometheus.CounterVec
+	evictions     prometheus.Counter
+	evictedMsgs   prometheus.Counter
+	recalls       *prometheus.CounterVec
+	utilization   *prometheus.GaugeVec
+	storageErrors *prometheus.CounterVec
+	queueDepth    prometheus.Gauge
+}
+
+// newMetrics registers the collectors, processors registered with
+// the same registerer (e.g. after switching sessions) share them
+func newMetrics(registerer prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		turns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "turns_total",
+			Help:      "Turns started, by the role of the message that started them.",
+		}, []string{"trigger"}),
+		llmDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "llm_request_duration_seconds",
+			Help:      "Latency of the conversational model calls.",
+			Buckets:   []float64{0.25, 0.5, 1, 2, 4, 8, 15, 30, 60, 120},
+		}, []string{"model", "outcome"}),
+		toolCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tool_calls_total",
+			Help:      "Functions called by the model, by name and outcome.",
+		}, []string{"function", "outcome"}),
+		evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "evictions_total",
+			Help:      "Flushes of short term memory to long term memory.",
+		}),
+		evictedMsgs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "evicted_messages_total",
+			Help:      "Messages moved from short term to long term memory.",
+		}),
+		recalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "recalls_total",
+			Help:      "Searches of the conversation history and archival memory, by whether anything was found.",
+		}, []string{"memory", "outcome"}),
+		utilization: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "context_utilization_ratio",
+			Help:      "Share of the section budget used at the last model call.",
+		}, []string{"section"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_errors_total",
+			Help:      "Failed storage operations, by operation.",
+		}, []string{"operation"}),
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Messages waiting for the processor.",
+		}),
+	}
+
+	err := errors.Join(
+		register(registerer, &m.turns),
+		register(registerer, &m.llmDuration),
+		register(registerer, &m.toolCalls),
+		register(registerer, &m.evictions),
+		register(registerer, &m.evictedMsgs),
+		register(registerer, &m.recalls),
+		register(registerer, &m.utilization),
+		register(registerer, &m.storageErrors),
+		register(registerer, &m.queueDepth),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// register replaces the collector with the one already registered under its name
+func register[C prometheus.Collector](registerer prometheus.Registerer, collector *C) error {
+	err := registerer.Register(*collector)
+
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		if existing, ok := registered.ExistingCollector.(C); ok {
+			*collector = existing
+			return nil
+		}
+	}
+
+	return err
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "ok"
+}
+
+func (m *metrics) turnStarted(trigger string) {
+	if m == nil {
+		return
+	}
+
+	m.turns.WithLabelValues(trigger).Inc()
+}
+
+func (m *metrics) modelCalled(model string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.llmDuration.WithLabelValues(model, outcome(err)).Observe(duration.Seconds())
+}
+
+func (m *metrics) functionCalled(function string, err error) {
+	if m == nil {
+		return
+	}
+
+	m.toolCalls.WithLabelValues(function, outcome(err)).Inc()
+}
+
+func (m *metrics) evicted(messages int) {
+	if m == nil {
+		return
+	}
+
+	m.evictions.Inc()
+	m.evictedMsgs.Add(float64(messages))
+}
+
+// recalled counts a search of the "conversation" or "archival" memory
+func (m *metrics) recalled(memory string, found bool) {
+	if m == nil {
+		return
+	}
+
+	result := "miss"
+	if found {
+		result = "hit"
+	}
+
+	m.recalls.WithLabelValues(memory, result).Inc()
+}
+
+// contextUsed records the utilization of the context sections, it runs
+// on the processor's goroutine since the context is not safe to read
+// concurrently with a scrape
+func (m *metrics) contextUsed(mainContext *MemoryContext) {
+	if m == nil {
+		return
+	}
+
+	if mainContext.workingCtxSize > 0 {
+		m.utilization.WithLabelValues("working_context").Set(float64(mainContext.CurrentWorkingContextSize()) / float64(mainContext.workingCtxSize))
+	}
+
+	if mainContext.msgsSize > 0 {
+		m.utilization.WithLabelValues("messages").Set(float64(mainContext.CurrentMessagesSize()) / float64(mainContext.msgsSize))
+	}
+}
+
+// queued records the messages waiting in mainProc
+func (m *metrics) queued(depth int) {
+	if m == nil {
+		return
+	}
+
+	m.queueDepth.Set(float64(depth))
+}
+
+func (m *metrics) storageFailed(operation string, err error) {
+	if m == nil || err == nil {
+		return
+	}
+
+	m.storageErrors.WithLabelValues(operation).Inc()
+}
@@ -1,23 +1,32 @@
 package memory
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 
-	"github.com/pkoukk/tiktoken-go"
 	"github.com/tmc/langchaingo/llms"
 )
 
 type MemoryOperator struct {
 	MainContext *MemoryContext
 	Storage     MemoryStorage
+	Summarizer  *Summarizer
+	Scheduler   *Scheduler
+
+	logger  *slog.Logger
+	metrics *metrics
 }
 
-func NewMemoryOperator(mainContext *MemoryContext) *MemoryOperator {
+func NewMemoryOperator(mainContext *MemoryContext, summarizer *Summarizer, scheduler *Scheduler) *MemoryOperator {
 	return &MemoryOperator{
 		MainContext: mainContext,
 		Storage:     mainContext.Storage,
+		Summarizer:  summarizer,
+		Scheduler:   scheduler,
+		logger:      NopLogger(),
 	}
 }
 
@@ -32,10 +41,23 @@ func (operator MemoryOperator) Load() error {
 		return err
 	}
 
-	operator.MainContext.Messages = msgs
+	summary, err := operator.Storage.LoadSummary()
+	if err != nil {
+		return err
+	}
+
+	pinnedMsgs, err := operator.Storage.LoadPinnedMessages()
+	if err != nil {
+		return err
+	}
+
+	operator.MainContext.SetQueue(msgs)
 	operator.MainContext.WorkingContext = workingContext
+	operator.MainContext.Summary = summary
 
-	// log.Printf("Messages loaded: %v", operator.MainContext.Messages)
+	for _, msg := range pinnedMsgs {
+		operator.MainContext.pinned[messageKey(msg)] = struct{}{}
+	}
 
 	return nil
 }
@@ -43,8 +65,8 @@ func (operator MemoryOperator) Load() error {
 // Save current memory context state to core memory
 func (operator MemoryOperator) Save() error {
 
-	err := operator.Storage.SaveMessages(operator.MainContext.Messages)
-	if err != nil {
+	err := operator.Storage.SaveMessages(operator.MainContext.Queue())
+	if err != nil && !errors.Is(err, ErrNoNewMessages) {
 		return err
 	}
 
@@ -56,13 +78,18 @@ func (operator MemoryOperator) Save() error {
 	return nil
 }
 
-func (operator MemoryOperator) Reflect(summary string) error {
+func (operator MemoryOperator) Reflect(ctx context.Context, summary string) error {
 	// inputs is working contex. Summary generated
-	// by llm based on all the current messsages in context
+	// by llm based on all the current messsages in context,
+	// the summarizer shortens it when it exceeds the working context budget
+	summary, err := operator.Summarizer.Fit(ctx, summary, int(operator.MainContext.workingCtxSize))
+	if err != nil {
+		return err
+	}
 
 	operator.MainContext.WorkingContext = summary
 
-	err := operator.Storage.SaveWorkingContext(operator.MainContext.WorkingContext)
+	err = operator.Storage.SaveWorkingContext(operator.MainContext.WorkingContext)
 	if err != nil {
 		return err
 	}
@@ -71,70 +98,133 @@ func (operator MemoryOperator) Reflect(summary string) error {
 }
 
 // Move infromation from core memory to archive memory
-func (operator MemoryOperator) Memorize(summary string) error {
+func (operator MemoryOperator) Memorize(ctx context.Context) error {
 	// can happen when chat history is full
 	// save chat history msgs to archive storage
 	// removes overflowing messages in chat history
-	// saves the new summary to core memory and archive memory
-	// input should be the summary of the flushed chat history messages
+	// folds the evicted messages into the recursive summary
 
-	// we flush all the messages from shrot term memory and leave only the last 3
-	// the evicted messages are appended to long term memory
-	// this is probably a temp solution
-	// clanedMsgs := operator.MainContext.Messages[max(0, len(operator.MainContext.Messages)-3):]
+	// the eviction policy decides which messages are flushed from
+	// short term memory, the evicted messages are appended to long term memory
+	err := operator.Storage.SaveMessages(operator.MainContext.Queue())
+	if err != nil && !errors.Is(err, ErrNoNewMessages) {
+		operator.logger.Error("saving messages", "error", err)
+		return err
+	}
 
-	// err = operator.Storage.SaveMessages(clanedMsgs)
-	// if err != nil {
-	// 	return err
-	// }
+	evicted, kept := operator.MainContext.Evict()
+	if len(evicted) == 0 {
+		return errors.New("no messages to evict from short term memory")
+	}
 
-	// operator.MainContext.Messages = clanedMsgs
-	err := operator.Storage.SaveMessages(operator.MainContext.Messages)
+	operator.logger.Debug("evicting messages", "evicted", len(evicted), "kept", len(kept))
+
+	// summarize before archiving so a failed llm call leaves the memory untouched
+	summary, err := operator.Summarizer.Summarize(ctx, operator.MainContext.Summary, evicted)
 	if err != nil {
-		log.Printf("Error saving messages: %v", err)
+		operator.logger.Error("summarizing messages", "error", err)
 		return err
 	}
 
-	err = operator.Storage.ArchiveMessages(operator.MainContext.Messages)
+	err = operator.Storage.ArchiveMessages(evicted)
 	if err != nil {
-		log.Printf("Error archiving messages: %v", err)
+		operator.logger.Error("archiving messages", "messages", len(evicted), "error", err)
 		return err
 	}
 
-	err = operator.Storage.SaveWorkingContext(summary)
+	err = operator.Storage.SaveSummary(summary)
 	if err != nil {
-		log.Printf("Error saving working context: %v", err)
+		operator.logger.Error("saving summary", "error", err)
 		return err
 	}
 
-	msgs, err := operator.Storage.LoadMessages()
-	if err != nil {
-		log.Printf("Error loading messages: %v", err)
+	operator.MainContext.SetQueue(kept)
+	operator.MainContext.Summary = summary
+	operator.metrics.evicted(len(evicted))
+
+	operator.logger.Info("messages memorized", "archived", len(evicted), "summary_tokens", operator.MainContext.CurrentSummarySize())
+
+	return nil
+}
+
+// Reset moves the short term memory to long term memory and clears the
+// recursive summary, the working context and pinned messages are kept
+func (operator MemoryOperator) Reset() error {
+	err := operator.Storage.SaveMessages(operator.MainContext.Queue())
+	if err != nil && !errors.Is(err, ErrNoNewMessages) {
+		operator.logger.Error("saving messages", "error", err)
 		return err
 	}
 
-	workingCtx, err := operator.Storage.LoadWorkingContext()
+	evicted := []llms.MessageContent{}
+	kept := []llms.MessageContent{}
+	for _, msg := range operator.MainContext.Queue() {
+		if operator.MainContext.IsPinned(msg) {
+			kept = append(kept, msg)
+		} else {
+			evicted = append(evicted, msg)
+		}
+	}
+
+	if len(evicted) > 0 {
+		err = operator.Storage.ArchiveMessages(evicted)
+		if err != nil {
+			operator.logger.Error("archiving messages", "messages", len(evicted), "error", err)
+			return err
+		}
+	}
+
+	err = operator.Storage.SaveSummary("")
 	if err != nil {
-		log.Printf("Error loading working context: %v", err)
+		operator.logger.Error("saving summary", "error", err)
 		return err
 	}
 
-	operator.MainContext.Messages = msgs
-	operator.MainContext.WorkingContext = workingCtx
+	operator.MainContext.SetQueue(kept)
+	operator.MainContext.Summary = ""
+	operator.metrics.evicted(len(evicted))
+
+	operator.logger.Info("memory reset", "archived", len(evicted), "pinned", len(kept))
 
 	return nil
 }
 
-func (operator MemoryOperator) Recall(query string, limit, page int) error {
-	msgs, err := operator.Storage.RecallMessages(query, limit, page)
+func (operator MemoryOperator) Recall(query RecallQuery, page int) (string, error) {
+	if query.Limit <= 0 {
+		query.Limit = recallPageSize
+	}
+
+	if page < 1 {
+		page = 1
+	}
+
+	query.Offset = (page - 1) * query.Limit
+
+	result, err := operator.Storage.RecallMessages(query)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	operator.metrics.recalled("conversation", result.Total > 0)
+
+	if result.Total == 0 {
+		return "No messages found in conversation history", nil
 	}
 
-	encoder, err := tiktoken.GetEncoding("cl100k_base")
+	pages := (result.Total + query.Limit - 1) / query.Limit
+	if len(result.Messages) == 0 {
+		return fmt.Sprintf("No messages on page %d, conversation history has %d pages", page, pages), nil
+	}
+
+	msgs := ""
+	for _, msg := range result.Messages {
+		msgs += msg.String() + "\n"
+	}
+
+	encoder, err := getEncoder()
 	if err != nil {
-		log.Printf("Error creating tiktoken encoder: %v", err)
-		return errors.New(fmt.Sprintf("error creating tiktoken encoder: %v", err))
+		operator.logger.Error("creating tiktoken encoder", "error", err)
+		return "", errors.New(fmt.Sprintf("error creating tiktoken encoder: %v", err))
 	}
 
 	msgSize := len(encoder.Encode(msgs, nil, nil))
@@ -143,10 +233,139 @@ func (operator MemoryOperator) Recall(query string, limit, page int) error {
 		chatHistory := llms.TextParts(llms.ChatMessageTypeSystem, msgs)
 		operator.MainContext.Messages = append(operator.MainContext.Messages, chatHistory)
 
-		return nil
+		return fmt.Sprintf("Conversation history recalled, showing %d of %d messages, page %d/%d", len(result.Messages), result.Total, page, pages), nil
+	}
+
+	return "", errors.New("Memory overflow: request less messages per page or clear your memory")
+}
+
+// Store a fact or document in archival memory
+func (operator MemoryOperator) ArchivalInsert(ctx context.Context, content string, tags []string) error {
+	if strings.TrimSpace(content) == "" {
+		return errors.New("archival memory content is empty")
+	}
+
+	passage := Passage{
+		Content: content,
+		Tags:    tags,
+	}
+
+	if operator.MainContext.Embedder != nil {
+		embedding, err := operator.MainContext.Embedder.EmbedQuery(ctx, content)
+		if err != nil {
+			operator.logger.Error("embedding passage", "error", err)
+			return err
+		}
+
+		passage.Embedding = embedding
+	}
+
+	return operator.Storage.InsertPassages([]Passage{passage})
+}
+
+// Search archival memory, pages start at 1
+func (operator MemoryOperator) ArchivalSearch(ctx context.Context, search string, page int) (string, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	query := PassageQuery{
+		Search: search,
+		Limit:  archivalPageSize,
+		Offset: (page - 1) * archivalPageSize,
+	}
+
+	if operator.MainContext.Embedder != nil {
+		embedding, err := operator.MainContext.Embedder.EmbedQuery(ctx, search)
+		if err != nil {
+			operator.logger.Error("embedding search query", "error", err)
+			return "", err
+		}
+
+		query.Embedding = embedding
+	}
+
+	passages, total, err := operator.Storage.SearchPassages(query)
+	if err != nil {
+		return "", err
+	}
+
+	operator.metrics.recalled("archival", total > 0)
+
+	if total == 0 {
+		return "No passages found in archival memory", nil
+	}
+
+	pages := (total + archivalPageSize - 1) / archivalPageSize
+	if len(passages) == 0 {
+		return fmt.Sprintf("No passages on page %d, archival memory has %d pages", page, pages), nil
+	}
+
+	results := fmt.Sprintf("Showing %d of %d passages, page %d/%d\n", len(passages), total, page, pages)
+	for _, passage := range passages {
+		results += passage.String() + "\n"
+	}
+
+	return results, nil
+}
+
+// Pin keeps the most recent message containing the text in short term memory
+func (operator MemoryOperator) Pin(text string) error {
+	msg, err := operator.MainContext.FindMessage(text)
+	if err != nil {
+		return err
+	}
+
+	return operator.MainContext.Pin(msg)
+}
+
+func (operator MemoryOperator) Unpin(text string) error {
+	msg, err := operator.MainContext.FindMessage(text)
+	if err != nil {
+		return err
+	}
+
+	if !operator.MainContext.IsPinned(msg) {
+		return errors.New("message is not pinned")
+	}
+
+	return operator.MainContext.Unpin(msg)
+}
+
+// Tag labels the most recent message containing the text, tagged
+// messages can be recalled by their tags once they are archived
+func (operator MemoryOperator) Tag(text string, tags []string) error {
+	tags = NormalizeTags(tags)
+	if len(tags) == 0 {
+		return errors.New("no tags given")
+	}
+
+	msg, err := operator.MainContext.FindMessage(text)
+	if err != nil {
+		return err
+	}
+
+	return operator.Storage.TagMessage(msg, tags)
+}
+
+func (operator MemoryOperator) ScheduleReminder(at string, note string) (string, error) {
+	now := operator.Scheduler.clock.Now()
+
+	reminderTime, err := parseReminderTime(at, now)
+	if err != nil {
+		return "", err
+	}
+
+	if !reminderTime.After(now) {
+		return "", errors.New("reminder time is in the past")
+	}
+
+	reminder, err := operator.Scheduler.Remind(reminderTime, note)
+	if err != nil {
+		return "", err
 	}
 
-	return errors.New("Memory overflow: request less messages per page or clear your memory")
+	return fmt.Sprintf("Reminder scheduled for %s", reminder.At.Format("January 02, 2006, 15:04:05")), nil
 }
 
 func (operator MemoryOperator) Think(thought string) string {
@@ -0,0 +1,126 @@
+package memory
+
+import (
+	"fmt"
+	"time"
+)
+
+// PressureKind is the memory section a pressure warning is raised for
+type PressureKind string
+
+const (
+	PressureWorkingContext PressureKind = "memoryPressure:WorkingContext"
+	PressureMessages       PressureKind = "memoryPressure:Messages"
+)
+
+// PressureLevel grades how full a memory section is
+type PressureLevel int
+
+const (
+	PressureNone PressureLevel = iota
+	PressureNotice
+	PressureWarn
+	PressureCritical
+	// the section is over budget and has to be flushed by the system
+	PressureFull
+)
+
+// share of the section budget at which each level is reached
+var pressureThresholds = map[PressureLevel]float32{
+	PressureNotice:   0.7,
+	PressureWarn:     0.85,
+	PressureCritical: 0.95,
+	PressureFull:     1,
+}
+
+func (level PressureLevel) String() string {
+	switch level {
+	case PressureNotice:
+		return "Notice"
+	case PressureWarn:
+		return "Warning"
+	case PressureCritical:
+		return "Critical"
+	case PressureFull:
+		return "Full"
+	default:
+		return "None"
+	}
+}
+
+// MemoryPressure is a pressure level newly reached by a memory section
+type MemoryPressure struct {
+	Kind   PressureKind
+	Level  PressureLevel
+	Size   int
+	Budget int
+}
+
+func pressureLevel(size int, budget float32) PressureLevel {
+	level := PressureNone
+	for _, candidate := range []PressureLevel{PressureNotice, PressureWarn, PressureCritical, PressureFull} {
+		if size >= int(budget*pressureThresholds[candidate]) {
+			level = candidate
+		}
+	}
+
+	return level
+}
+
+// InspectMemoryPressure returns the sections that reached a higher pressure
+// level, each level is reported once until the section drops below it again.
+func (system *SystemMonitor) InspectMemoryPressure() []MemoryPressure {
+	sections := []MemoryPressure{
+		{
+			Kind:   PressureWorkingContext,
+			Size:   system.mainContext.CurrentWorkingContextSize(),
+			Budget: int(system.mainContext.workingCtxSize),
+		},
+		{
+			Kind:   PressureMessages,
+			Size:   system.mainContext.CurrentMessagesSize(),
+			Budget: int(system.mainContext.msgsSize),
+		},
+	}
+
+	pressures := []MemoryPressure{}
+	for _, section := range sections {
+		section.Level = pressureLevel(section.Size, float32(section.Budget))
+
+		if section.Level <= system.pressure[section.Kind] {
+			// the pressure dropped, lower levels can fire again
+			system.pressure[section.Kind] = section.Level
+			continue
+		}
+
+		system.pressure[section.Kind] = section.Level
+		pressures = append(pressures, section)
+	}
+
+	return pressures
+}
+
+// PressureWarning renders the instruction for the pressure level
+// of a memory section of the given size
+func (system *SystemMonitor) PressureWarning(kind PressureKind, level PressureLevel, size int) (string, error) {
+	variables := map[string]any{
+		"time": formatTime(time.Now()),
+	}
+
+	switch kind {
+	case PressureWorkingContext:
+		variables["workingContextSize"] = size
+		variables["budgetSize"] = int(system.mainContext.workingCtxSize)
+	case PressureMessages:
+		variables["messagesSize"] = size
+		variables["budgetSize"] = int(system.mainContext.msgsSize)
+	default:
+		return "", fmt.Errorf("unknown memory pressure kind %q", kind)
+	}
+
+	if level == PressureNone {
+		return "", fmt.Errorf("no memory pressure to report for %s", kind)
+	}
+
+	return system.render(string(kind)+":"+level.String(), variables)
+}
@@ -0,0 +1,122 @@
+package memory_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/memory/memorytest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestPressureLevels(t *testing.T) {
+	mainContext := memory.NewMemoryContext(openStorage(t, dbPath(t)), memory.WithContextSize(2000))
+	system, err := memory.NewSystemMonitor(mainContext)
+	if err != nil {
+		t.Fatalf("creating system monitor: %v", err)
+	}
+
+	budget := mainContext.Stats().WorkingContext.Budget
+
+	// fill sets a working context of at least the share of the budget
+	fill := func(share float64) {
+		target := int(share * float64(budget))
+		words := []string{}
+		mainContext.WorkingContext = ""
+		for size := 0; size < target; size = mainContext.CurrentWorkingContextSize() {
+			// a word takes up a token at most
+			for i := size; i < target; i++ {
+				words = append(words, "fact")
+			}
+
+			mainContext.WorkingContext = strings.Join(words, " ")
+		}
+	}
+
+	inspect := func(step string, want ...memory.PressureLevel) {
+		t.Helper()
+
+		levels := []memory.PressureLevel{}
+		for _, pressure := range system.InspectMemoryPressure() {
+			if pressure.Kind != memory.PressureWorkingContext {
+				t.Errorf("%s: %s reported, want only the working context", step, pressure.Kind)
+				continue
+			}
+
+			levels = append(levels, pressure.Level)
+		}
+
+		if fmt.Sprint(levels) != fmt.Sprint(want) {
+			t.Errorf("%s: levels = %v, want %v", step, levels, want)
+		}
+	}
+
+	fill(0.75)
+	inspect("filling up", memory.PressureNotice)
+	inspect("same size")
+
+	// only the highest level reached is reported
+	fill(0.96)
+	inspect("almost full", memory.PressureCritical)
+	inspect("still almost full")
+
+	fill(1)
+	inspect("full", memory.PressureFull)
+
+	// a flushed section reports its levels again
+	fill(0.3)
+	inspect("flushed")
+
+	fill(0.75)
+	inspect("filling up again", memory.PressureNotice)
+}
+
+func TestFailedFlushIsRetried(t *testing.T) {
+	summarizer := memorytest.NewModel(
+		memorytest.Error(errors.New("rate limited")),
+		memorytest.Text("Ana is planning a trip to Rome in May."),
+	)
+
+	model := memorytest.NewModel(
+		memorytest.Text("Rome it is."),
+		memorytest.Text("Noted.").
+			Expect(lastContains(llms.ChatMessageTypeSystem, "Memory pressure critical: Messages")),
+		memorytest.Text("Still here.").
+			Expect(contains(llms.ChatMessageTypeSystem, "Ana is planning a trip to Rome in May.")),
+		memorytest.Text("Noted.").
+			Expect(lastContains(llms.ChatMessageTypeSystem, "Messages were full")),
+	)
+
+	h := newHarness(t, dbPath(t), model,
+		[]memory.ContextOption{memory.WithContextSize(600)},
+		memory.WithSummarizer(summarizer),
+	)
+
+	// fill short term memory past its budget
+	for i := 0; i < 12; i++ {
+		err := h.processor.System.AppendMessage(llms.TextParts(llms.ChatMessageTypeHuman,
+			fmt.Sprintf("Message %d: I'd like to plan a trip to Rome in May, somewhere close to the old town with good food and a view of the river.", i)))
+		if err != nil {
+			t.Fatalf("appending message: %v", err)
+		}
+	}
+
+	h.start()
+
+	// the flush fails and the model is warned instead
+	h.say("Where should I go?")
+	h.waitTurn()
+
+	// the queue is still full, the flush runs again
+	h.say("Are you still there?")
+	h.waitTurn()
+
+	h.stop()
+	h.checkModel(summarizer)
+
+	if h.context.Summary != "Ana is planning a trip to Rome in May." {
+		t.Errorf("summary = %q", h.context.Summary)
+	}
+}
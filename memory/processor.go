@@ -2,48 +2,354 @@ package memory
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/Struki84/GoMemGPT/logger"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tmc/langchaingo/llms"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type step struct {
 	msg llms.MessageContent
 }
 
+// input is a message from outside the processor, the replies of the turn it
+// starts go to output and done is called once the turn ended
+type input struct {
+	msg    llms.MessageContent
+	output func(llms.MessageContent)
+	done   func()
+}
+
 type LLMProcessor struct {
-	llm      llms.Model
-	System   *SystemMonitor
-	mainProc chan llms.MessageContent
-	executor Executor
-	output   func(llms.MessageContent)
+	llm       llms.Model
+	System    *SystemMonitor
+	Scheduler *Scheduler
+	mainProc  chan input
+	tasks     chan func(context.Context)
+	executor  Executor
+	notify    func(llms.MessageContent)
+	observe   func(FunctionCall)
+	clock     Clock
+	logger    *slog.Logger
+
+	// the input of the current turn and the messages it caused (model
+	// responses, heartbeats and warnings) waiting to be handled
+	caller  input
+	pending []llms.MessageContent
+
+	// turn counts the user messages, step the model calls of the turn
+	turn int
+	step int
+
+	// the turn span covers the model calls and functions from the
+	// message that woke the model until its reply
+	tracerProvider trace.TracerProvider
+	tracer         trace.Tracer
+	storage        *tracedStorage
+	turnCtx        context.Context
+	turnSpan       trace.Span
+	turnErr        error
+
+	// name of the conversational model reported in the spans and usage
+	modelName string
+	pricing   Pricing
+
+	// prometheus collectors, disabled when registerer is nil
+	registerer prometheus.Registerer
+	metrics    *metrics
+
+	// usage limits checked before each model call, the agent is
+	// told once per reached limit
+	sessionLimits  Limits
+	globalLimits   Limits
+	budgetNotified string
+
+	// dedicated model for memory summaries, defaults to llm
+	summarizationLLM llms.Model
+
+	systemOpts []SystemOption
+
+	// idle time consolidation, disabled when idlePeriod is 0
+	consolidator     *Consolidator
+	consolidationLLM llms.Model
+	idlePeriod       time.Duration
+	idle             Timer
+	consolidating    bool
+	consolidated     bool
+}
+
+type ProcessorOption func(*LLMProcessor)
+
+// WithTracerProvider records the turns, model and function calls and storage
+// operations as spans, the global provider is used by default.
+func WithTracerProvider(provider trace.TracerProvider) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.tracerProvider = provider
+	}
+}
+
+// WithMetrics registers the processor's prometheus collectors, e.g. with
+// prometheus.DefaultRegisterer. Processors registered with the same
+// registerer add up into the same series.
+func WithMetrics(registerer prometheus.Registerer) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.registerer = registerer
+	}
+}
+
+// WithNotifications calls fn with the replies of turns nobody waits for,
+// e.g. to reminders, scheduled jobs and events. It runs on the processor's
+// goroutine and shouldn't block.
+func WithNotifications(fn func(llms.MessageContent)) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.notify = fn
+	}
+}
+
+// FunctionCall is a function the model ran and its result.
+type FunctionCall struct {
+	Turn      int
+	Step      int
+	Name      string
+	Arguments string
+	Result    string
+	Err       error
+	Duration  time.Duration
 }
 
-func NewLLMProcessor(llm llms.Model, mainContext *MemoryContext) *LLMProcessor {
+// WithFunctionCalls calls fn with every function the model runs, on the
+// processor's goroutine, e.g. to show the agent's inner monologue.
+func WithFunctionCalls(fn func(FunctionCall)) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.observe = fn
+	}
+}
+
+// WithModelName sets the name of the conversational model, the model
+// interface doesn't expose it. Name the summarization and consolidation
+// models with NamedModel.
+func WithModelName(name string) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.modelName = name
+	}
+}
+
+// WithLogger logs the turns, model and function calls and memory
+// operations, nothing is logged by default.
+func WithLogger(logger *slog.Logger) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.logger = logger
+	}
+}
+
+// WithClock replaces the system clock used by the scheduler.
+func WithClock(clock Clock) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.clock = clock
+	}
+}
+
+// WithSystemOptions configures the templates and persona of the system monitor.
+func WithSystemOptions(opts ...SystemOption) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.systemOpts = append(processor.systemOpts, opts...)
+	}
+}
+
+// WithSummarizer writes the summaries of memory operations (eviction,
+// Reflect and consolidation) with a dedicated model instead of the
+// conversational one.
+func WithSummarizer(llm llms.Model) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.summarizationLLM = llm
+	}
+}
+
+// WithConsolidation runs a memory consolidation cycle on the given
+// (possibly cheaper) model after the conversation was idle for the period,
+// a nil model falls back to the summarization model.
+func WithConsolidation(llm llms.Model, idlePeriod time.Duration) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.consolidationLLM = llm
+		processor.idlePeriod = idlePeriod
+	}
+}
+
+// WithPricing replaces the model prices used for the cost estimates of Usage.
+func WithPricing(pricing Pricing) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.pricing = pricing
+	}
+}
+
+// WithSessionLimits limits the usage of the current session.
+func WithSessionLimits(limits Limits) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.sessionLimits = limits
+	}
+}
+
+// WithGlobalLimits limits the usage of all sessions in the storage together.
+func WithGlobalLimits(limits Limits) ProcessorOption {
+	return func(processor *LLMProcessor) {
+		processor.globalLimits = limits
+	}
+}
+
+func NewLLMProcessor(llm llms.Model, mainContext *MemoryContext, opts ...ProcessorOption) (*LLMProcessor, error) {
+	processor := &LLMProcessor{
+		llm:            llm,
+		mainProc:       make(chan input, 100),
+		tasks:          make(chan func(context.Context)),
+		clock:          systemClock{},
+		logger:         NopLogger(),
+		tracerProvider: otel.GetTracerProvider(),
+		pricing:        DefaultPricing,
+	}
+
+	for _, opt := range opts {
+		opt(processor)
+	}
+
+	if processor.modelName == "" {
+		processor.modelName = modelName(llm)
+	}
+
+	summarizationName := modelName(processor.summarizationLLM)
+	if processor.summarizationLLM == nil {
+		processor.summarizationLLM = llm
+		summarizationName = processor.modelName
+	}
+
+	processor.tracer = processor.tracerProvider.Tracer(tracerName)
+
+	if processor.registerer != nil {
+		metrics, err := newMetrics(processor.registerer)
+
+		if err != nil {
+			return nil, fmt.Errorf("registering metrics: %w", err)
+		}
+
+		processor.metrics = metrics
+	}
+
+	// every memory component sees the traced storage
+	processor.storage = newTracedStorage(mainContext.Storage, processor.tracer)
+	processor.storage.metrics = processor.metrics
+	mainContext.Storage = processor.storage
+
+	system, err := NewSystemMonitor(mainContext, processor.systemOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	mainContext.logger = processor.logger
+	system.logger = processor.logger
+
+	processor.System = system
+	processor.Scheduler = NewScheduler(mainContext.Storage, processor.clock)
+	processor.Scheduler.logger = processor.logger
+
+	// memory operations record their usage, the chat usage is recorded by callLLM
+	if processor.System.mainContext.Embedder != nil {
+		processor.meterEmbedder(mainContext)
+	}
+
+	summarizationLLM := processor.meter(processor.summarizationLLM, UsageSummarization, summarizationName, mainContext)
+
+	summarizer := NewSummarizer(summarizationLLM, processor.System)
+	summarizer.logger = processor.logger
+
+	processor.executor = NewExecutor(mainContext, summarizer, processor.Scheduler)
+	processor.executor.logger = processor.logger
+	processor.executor.operator.logger = processor.logger
+	processor.executor.operator.metrics = processor.metrics
+	processor.executor.tracer = processor.tracer
+	processor.executor.storage = processor.storage
+
+	if processor.idlePeriod > 0 {
+		consolidationLLM := processor.consolidationLLM
+		consolidationName := modelName(consolidationLLM)
+		if consolidationLLM == nil {
+			consolidationLLM = processor.summarizationLLM
+			consolidationName = summarizationName
+		}
 
-	exec := NewExecutor(mainContext)
+		consolidationLLM = processor.meter(consolidationLLM, UsageConsolidation, consolidationName, mainContext)
+		processor.consolidator = NewConsolidator(consolidationLLM, processor.System, mainContext, summarizer)
+		processor.consolidator.logger = processor.logger
+		processor.idle = processor.clock.NewTimer(processor.idlePeriod)
+	}
 
 	// load chat history.
 	// tmp solution since I don't like it this way
-	exec.operator.Load()
+	err = processor.executor.operator.Load()
+	if err != nil {
+		processor.logger.Warn("loading memory", "error", err)
+	}
 
-	return &LLMProcessor{
-		llm:      llm,
-		System:   NewSystemMonitor(mainContext),
-		executor: exec,
-		mainProc: make(chan llms.MessageContent, 100),
+	err = processor.Scheduler.Load()
+	if err != nil {
+		processor.logger.Error("loading reminders", "error", err)
 	}
+
+	return processor, nil
 }
 
+// Input wakes the model with a message that nobody waits for, e.g. an event,
+// the replies go to the notifications.
 func (processor *LLMProcessor) Input(msg llms.MessageContent) {
-	processor.mainProc <- msg
+	processor.mainProc <- input{msg: msg}
+	processor.metrics.queued(len(processor.mainProc))
+}
+
+// Call adds the user's message to memory and wakes the model, output is called with each
+// reply of the turn and done once the turn ended, after the last reply. A
+// turn can end without a reply, e.g. when the model only ran functions.
+func (processor *LLMProcessor) Call(msg llms.MessageContent, output func(llms.MessageContent), done func()) {
+	processor.mainProc <- input{msg: msg, output: output, done: done}
+	processor.metrics.queued(len(processor.mainProc))
 }
 
-func (processor *LLMProcessor) Output(fn func(llms.MessageContent)) {
-	processor.output = fn
+// Do runs fn on the processor's goroutine between two turns and waits
+// for it, the memory is only safe to read and change there while Run runs.
+func (processor *LLMProcessor) Do(fn func(ctx context.Context)) {
+	done := make(chan struct{})
+
+	processor.tasks <- func(ctx context.Context) {
+		defer close(done)
+		fn(ctx)
+	}
+
+	<-done
+}
+
+// Operator returns the memory operator the model's functions run on,
+// call its methods from Do.
+func (processor *LLMProcessor) Operator() *MemoryOperator {
+	return &processor.executor.operator
+}
+
+// Emit formats the event through the system templates and wakes the model,
+// the replies go to the notifications
+func (processor *LLMProcessor) Emit(event Event) error {
+	eventMsg, err := processor.System.Event(event)
+	if err != nil {
+		return err
+	}
+
+	processor.Input(eventMsg)
+
+	return nil
 }
 
 func (processor *LLMProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
@@ -51,102 +357,363 @@ func (processor *LLMProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	for {
 		select {
-		case msg, ok := <-processor.mainProc:
+		case in, ok := <-processor.mainProc:
 			if !ok {
-				log.Printf("Processor mainProc channel closed")
+				processor.logger.Debug("processor input closed")
 				return
 			}
 
-			processor.handleMessage(ctx, msg)
+			processor.metrics.queued(len(processor.mainProc))
+			processor.runTurn(ctx, in)
+		case task := <-processor.tasks:
+			task(ctx)
+		case <-processor.Scheduler.Timer():
+			processor.handleScheduled(ctx)
+		case <-processor.Scheduler.Changed():
+			processor.Scheduler.Reschedule()
+		case <-processor.idleTimer():
+			processor.consolidate(ctx)
 		case <-ctx.Done():
-			log.Printf("Processor mainProc loop done")
+			processor.logger.Debug("processor stopped")
 			return
 		}
 	}
 }
 
+// runTurn handles the input and every message it causes, the turn ends
+// once the model is not woken again
+func (processor *LLMProcessor) runTurn(ctx context.Context, in input) {
+	if in.msg.Role == llms.ChatMessageTypeHuman {
+		processor.turn++
+		processor.step = 0
+		processor.logger.Info("turn started", "turn", processor.turn)
+	}
+
+	processor.caller = in
+	processor.startTurn(ctx, in.msg.Role)
+	processor.pending = []llms.MessageContent{in.msg}
+
+	for len(processor.pending) > 0 {
+		msg := processor.pending[0]
+		processor.pending = processor.pending[1:]
+		processor.handleMessage(processor.turnCtx, msg)
+	}
+
+	processor.endTurn()
+	processor.caller = input{}
+
+	// the idle period starts over after every turn
+	processor.consolidating = false
+	processor.consolidated = false
+	processor.resetIdle(processor.idlePeriod)
+
+	if in.done != nil {
+		in.done()
+	}
+}
+
+// next queues a message of the current turn, it is handled before the next input
+func (processor *LLMProcessor) next(msg llms.MessageContent) {
+	processor.pending = append(processor.pending, msg)
+}
+
+// reply passes a message to the caller of the turn, turns nobody
+// waits for reply to the notifications
+func (processor *LLMProcessor) reply(msg llms.MessageContent) {
+	switch {
+	case processor.caller.output != nil:
+		processor.caller.output(msg)
+	case processor.notify != nil:
+		processor.notify(msg)
+	default:
+		processor.logger.Warn("reply dropped, nobody waits for it", "turn", processor.turn)
+	}
+}
+
+// idleTimer fires once the conversation was idle for the idle period and
+// right away while a cycle is running, consolidation runs once per idle period
+func (processor *LLMProcessor) idleTimer() <-chan time.Time {
+	if processor.consolidator == nil || processor.consolidated {
+		return nil
+	}
+
+	return processor.idle.C()
+}
+
+// resetIdle fires the idle timer after d, the timer is reused
+// so waiting between messages doesn't leave timers behind
+func (processor *LLMProcessor) resetIdle(d time.Duration) {
+	if processor.idle == nil {
+		return
+	}
+
+	processor.idle.Reset(d)
+}
+
+// consolidate runs one step of the consolidation cycle, the working context
+// and then one archived batch per step, so new messages wait for a single
+// model call at most
+func (processor *LLMProcessor) consolidate(ctx context.Context) {
+	if len(processor.mainProc) > 0 || ctx.Err() != nil {
+		return
+	}
+
+	if !processor.consolidating {
+		processor.consolidating = true
+		processor.logger.Debug("consolidating memory", "idle", processor.idlePeriod)
+
+		err := processor.consolidator.ConsolidateWorkingContext(ctx)
+		if err != nil {
+			processor.logger.Error("consolidating working context", "error", err)
+		}
+
+		processor.resetIdle(0)
+		return
+	}
+
+	more, err := processor.consolidator.ConsolidateArchive(ctx)
+	if err != nil {
+		processor.logger.Error("consolidating archived messages", "error", err)
+	}
+
+	if err != nil || !more {
+		processor.consolidating = false
+		processor.consolidated = true
+		return
+	}
+
+	processor.resetIdle(0)
+}
+
+// handleScheduled wakes the model with a system event for each due job and reminder
+func (processor *LLMProcessor) handleScheduled(ctx context.Context) {
+	for _, event := range processor.Scheduler.Due() {
+		eventMsg, err := processor.System.ScheduledEvent(event)
+		if err != nil {
+			processor.logger.Error("creating scheduled event", "reminder", event.Reminder, "error", err)
+			continue
+		}
+
+		processor.runTurn(ctx, input{msg: eventMsg})
+	}
+}
+
 func (processor *LLMProcessor) handleMessage(ctx context.Context, msg llms.MessageContent) {
-	logger.LogLastMessage(processor.System.mainContext.Messages)
+	processor.logger.Debug("handling message", append([]any{"turn", processor.turn, "step", processor.step}, messageAttrs(msg)...)...)
 
 	switch msg.Role {
 	case llms.ChatMessageTypeHuman:
+		// the message is added here, the memory is only changed on this goroutine
+		err := processor.System.AppendMessage(msg)
+		if err != nil {
+			processor.logger.Error("appending user message", "error", err)
+		}
+
+		// flush before the model is called on a full context
+		processor.CheckMemoryPressure(ctx)
 		processor.callLLM(ctx)
-	case llms.ChatMessageTypeSystem:
+	case llms.ChatMessageTypeSystem, ChatMessageTypeEvent:
 		processor.System.AppendMessage(msg)
 		processor.callLLM(ctx)
-	case llms.ChatMessageTypeTool:
-		output := false
+	case llms.ChatMessageTypeAI:
+		tool := false
+
+		// the model is only woken again when a function
+		// requests a heartbeat or a function fails
+		var heartbeat HeartbeatKind
+		function := ""
 
 		for _, part := range msg.Parts {
-			if toolResponse, ok := part.(llms.ToolCallResponse); ok {
-				if toolResponse.Name == "InternalOutput" {
-					output = true
-					newMsg := llms.TextParts(llms.ChatMessageTypeAI, toolResponse.Content)
-					processor.System.AppendMessage(newMsg)
-					processor.CheckMemoryPressure()
-				}
+			toolCall, ok := part.(llms.ToolCall)
+			if !ok {
+				continue
+			}
 
-				if toolResponse.Name == "ExternalOutput" {
-					output = true
-					newMsg := llms.TextParts(llms.ChatMessageTypeAI, toolResponse.Content)
-					processor.System.AppendMessage(newMsg)
-					processor.CheckMemoryPressure()
-					processor.mainProc <- newMsg
-				}
+			tool = true
+
+			start := time.Now()
+			executionResult, err := processor.executor.Run(ctx, toolCall)
+
+			logger := processor.logger.With(
+				"turn", processor.turn,
+				"step", processor.step,
+				"function", toolCall.FunctionCall.Name,
+				"duration", time.Since(start),
+			)
+
+			processor.metrics.functionCalled(toolCall.FunctionCall.Name, err)
+
+			if processor.observe != nil {
+				processor.observe(FunctionCall{
+					Turn:      processor.turn,
+					Step:      processor.step,
+					Name:      toolCall.FunctionCall.Name,
+					Arguments: toolCall.FunctionCall.Arguments,
+					Result:    executionResult,
+					Err:       err,
+					Duration:  time.Since(start),
+				})
 			}
-		}
 
-		if !output {
-			processor.callLLM(ctx)
-		}
-	case llms.ChatMessageTypeAI:
-		tool := false
+			if err != nil {
+				logger.Warn("function failed", "error", err)
+			} else {
+				logger.Info("function called")
+			}
 
-		for _, part := range msg.Parts {
-			if toolCall, ok := part.(llms.ToolCall); ok {
-				tool = true
+			if err != nil {
+				executionResult = fmt.Sprintf("Error running function: %v", err)
 
-				executionResult, err := processor.executor.Run(toolCall)
-				if err != nil {
-					executionResult = fmt.Sprintf("Error running function: %v", err)
+				if heartbeat != HeartbeatError {
+					heartbeat = HeartbeatError
+					function = toolCall.FunctionCall.Name
 				}
+			} else if heartbeat == "" && requestsHeartbeat(toolCall) {
+				heartbeat = HeartbeatRequested
+				function = toolCall.FunctionCall.Name
+			}
 
-				newMsg := llms.MessageContent{
-					Role: llms.ChatMessageTypeTool,
-					Parts: []llms.ContentPart{
-						llms.ToolCallResponse{
-							ToolCallID: toolCall.ID,
-							Name:       toolCall.FunctionCall.Name,
-							Content:    executionResult,
-						},
+			newMsg := llms.MessageContent{
+				Role: llms.ChatMessageTypeTool,
+				Parts: []llms.ContentPart{
+					llms.ToolCallResponse{
+						ToolCallID: toolCall.ID,
+						Name:       toolCall.FunctionCall.Name,
+						Content:    executionResult,
 					},
-				}
+				},
+			}
 
-				processor.System.AppendMessage(newMsg)
-				processor.CheckMemoryPressure()
+			processor.System.AppendMessage(newMsg)
+			processor.CheckMemoryPressure(ctx)
 
-				processor.mainProc <- newMsg
+			if err != nil {
+				continue
+			}
+
+			if toolCall.FunctionCall.Name == "InternalOutput" {
+				outputMsg := llms.TextParts(llms.ChatMessageTypeAI, executionResult)
+				processor.System.AppendMessage(outputMsg)
+				processor.CheckMemoryPressure(ctx)
+			}
+
+			if toolCall.FunctionCall.Name == "ExternalOutput" {
+				outputMsg := llms.TextParts(llms.ChatMessageTypeAI, executionResult)
+				processor.System.AppendMessage(outputMsg)
+				processor.CheckMemoryPressure(ctx)
+				processor.next(outputMsg)
 			}
 		}
 
-		if !tool && processor.output != nil {
-			processor.output(msg)
+		if heartbeat != "" {
+			heartbeatMsg, err := processor.System.Heartbeat(heartbeat, function)
+			if err != nil {
+				processor.logger.Error("creating heartbeat", "function", function, "error", err)
+			} else {
+				processor.next(heartbeatMsg)
+			}
 		}
 
+		if !tool {
+			processor.reply(msg)
+		}
 	}
 }
 
+// requestsHeartbeat checks the request_heartbeat argument of the function call
+func requestsHeartbeat(toolCall llms.ToolCall) bool {
+	var args struct {
+		RequestHeartbeat bool `json:"request_heartbeat"`
+	}
+
+	if err := json.Unmarshal([]byte(toolCall.FunctionCall.Arguments), &args); err != nil {
+		return false
+	}
+
+	return args.RequestHeartbeat
+}
+
 func (processor *LLMProcessor) callLLM(ctx context.Context) {
-	// log.Println(processor.System.mainContext.Messages)
-	response, err := processor.llm.GenerateContent(ctx, processor.System.mainContext.Messages,
+	err := processor.checkBudget()
+
+	var budgetErr *BudgetError
+	if errors.As(err, &budgetErr) {
+		processor.budgetExceeded(budgetErr)
+		processor.turnErr = err
+		return
+	}
+
+	processor.step++
+	logger := processor.logger.With("turn", processor.turn, "step", processor.step)
+
+	ctx, span := processor.tracer.Start(ctx, strings.TrimSpace("chat "+processor.modelName), trace.WithAttributes(
+		attribute.String("gen_ai.operation.name", "chat"),
+		attribute.String("gen_ai.request.model", processor.modelName),
+		attribute.Int("step", processor.step),
+	))
+
+	restore := processor.storage.withParent(ctx)
+
+	// memory operations since the last message can change the head
+	err = processor.System.RefreshHead()
+	if err != nil {
+		logger.Error("refreshing context head", "error", err)
+	}
+
+	messages := llmMessages(processor.System.mainContext.Messages)
+	span.SetAttributes(attribute.Int("messages", len(messages)))
+	processor.metrics.contextUsed(processor.System.mainContext)
+	start := time.Now()
+
+	response, err := processor.llm.GenerateContent(ctx, messages,
 		llms.WithTools(processor.executor.functions),
 	)
 
+	processor.metrics.modelCalled(processor.modelName, time.Since(start), err)
+
 	if err != nil {
-		log.Printf("Error generating response: %v", err)
+		logger.Error("generating response", "messages", len(messages), "duration", time.Since(start), "error", err)
+		endSpan(span, err)
+		restore()
+
+		// nothing wakes the model again
+		processor.turnErr = err
 		return
 	}
 
+	if len(response.Choices) == 0 {
+		err = errors.New("model returned no choices")
+		logger.Error("generating response", "messages", len(messages), "duration", time.Since(start), "error", err)
+		endSpan(span, err)
+		restore()
+
+		processor.turnErr = err
+		return
+	}
+
+	usage := processor.System.mainContext.measureUsage(messages, response)
+	usage.Purpose = UsageChat
+	usage.Model = processor.modelName
+	processor.recordUsage(usage)
+
+	span.SetAttributes(
+		attribute.Int("gen_ai.usage.input_tokens", usage.PromptTokens),
+		attribute.Int("gen_ai.usage.output_tokens", usage.CompletionTokens),
+		attribute.Bool("usage_estimated", usage.Estimated),
+		attribute.Int("function_calls", len(response.Choices[0].ToolCalls)),
+	)
+	endSpan(span, nil)
+	restore()
+
+	logger.Info("model called",
+		"messages", len(messages),
+		"prompt_tokens", usage.PromptTokens,
+		"completion_tokens", usage.CompletionTokens,
+		"estimated", usage.Estimated,
+		"function_calls", len(response.Choices[0].ToolCalls),
+		"duration", time.Since(start),
+	)
+
 	newMsg := llms.TextParts(llms.ChatMessageTypeAI, response.Choices[0].Content)
 
 	if len(response.Choices[0].ToolCalls) > 0 {
@@ -157,13 +724,131 @@ func (processor *LLMProcessor) callLLM(ctx context.Context) {
 	}
 
 	processor.System.AppendMessage(newMsg)
-	processor.mainProc <- newMsg
+	processor.next(newMsg)
+}
+
+// meter records the usage of the model calls of a memory operation
+func (processor *LLMProcessor) meter(llm llms.Model, purpose UsagePurpose, name string, mainContext *MemoryContext) llms.Model {
+	return meteredModel{
+		Model:   llm,
+		purpose: purpose,
+		name:    name,
+		context: mainContext,
+		record:  processor.recordUsage,
+	}
+}
+
+// meterEmbedder records the tokens embedded by archival memory
+func (processor *LLMProcessor) meterEmbedder(mainContext *MemoryContext) {
+	embedder := mainContext.Embedder
+	if metered, ok := embedder.(meteredEmbedder); ok {
+		embedder = metered.Embedder
+	}
+
+	mainContext.Embedder = meteredEmbedder{
+		Embedder: embedder,
+		name:     modelName(embedder),
+		context:  mainContext,
+		record:   processor.recordUsage,
+	}
+}
+
+// recordUsage attributes the usage to the current turn and stores it
+func (processor *LLMProcessor) recordUsage(usage Usage) {
+	if processor.turnCtx != nil {
+		usage.Turn = processor.turn
+	}
+
+	usage.CreatedAt = processor.clock.Now()
+
+	err := processor.storage.SaveUsage(usage)
+	if err != nil {
+		processor.logger.Error("saving usage", "purpose", usage.Purpose, "error", err)
+	}
+}
+
+// Usage totals the recorded usage and estimates its cost.
+func (processor *LLMProcessor) Usage(query UsageQuery) (UsageReport, error) {
+	return LoadUsageReport(processor.storage, query, processor.pricing)
 }
 
-func (processor *LLMProcessor) CheckMemoryPressure() {
-	systemWarrnings := processor.System.InspectMemoryPressure()
+// startTurn starts the span of a turn, storage operations outside
+// of model and function calls are linked to it
+func (processor *LLMProcessor) startTurn(ctx context.Context, trigger llms.ChatMessageType) {
+	processor.turnCtx, processor.turnSpan = processor.tracer.Start(ctx, "turn", trace.WithAttributes(
+		attribute.Int("turn", processor.turn),
+		attribute.String("trigger", string(trigger)),
+	))
+
+	processor.storage.withParent(processor.turnCtx)
+	processor.metrics.turnStarted(string(trigger))
+}
+
+// endTurn ends the turn span with the error of the last model call
+func (processor *LLMProcessor) endTurn() {
+	processor.turnSpan.SetAttributes(attribute.Int("steps", processor.step))
+	endSpan(processor.turnSpan, processor.turnErr)
+
+	processor.storage.withParent(context.Background())
+	processor.turnCtx = nil
+	processor.turnSpan = nil
+	processor.turnErr = nil
+}
+
+// CheckMemoryPressure warns the model once per newly reached pressure level,
+// a full section is flushed by the system before the model is told about it
+func (processor *LLMProcessor) CheckMemoryPressure(ctx context.Context) {
+	for _, pressure := range processor.System.InspectMemoryPressure() {
+		level := pressure.Level
+		size := pressure.Size
+
+		processor.logger.Info("memory pressure", "kind", pressure.Kind, "level", level, "size", pressure.Size, "budget", pressure.Budget)
+
+		if level == PressureFull {
+			var err error
+			size, err = processor.flush(ctx, pressure.Kind)
+			if err != nil {
+				processor.logger.Error("flushing memory", "kind", pressure.Kind, "error", err)
+				level = PressureCritical
+				size = pressure.Size
+
+				// the section is still full, the next check flushes it again
+				processor.System.pressure[pressure.Kind] = level
+			}
+		}
+
+		sysPrompt, err := processor.System.PressureWarning(pressure.Kind, level, size)
+		if err != nil {
+			processor.logger.Error("creating memory pressure warning", "kind", pressure.Kind, "level", level, "error", err)
+			continue
+		}
+
+		processor.next(llms.TextParts(llms.ChatMessageTypeSystem, sysPrompt))
+	}
+}
+
+// flush frees up a full memory section and returns its new size, messages
+// are moved to long term memory and the working context is shortened
+func (processor *LLMProcessor) flush(ctx context.Context, kind PressureKind) (int, error) {
+	mainContext := processor.System.mainContext
+	operator := processor.executor.operator
+
+	switch kind {
+	case PressureMessages:
+		err := operator.Memorize(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		return mainContext.CurrentMessagesSize(), nil
+	case PressureWorkingContext:
+		err := operator.Reflect(ctx, mainContext.WorkingContext)
+		if err != nil {
+			return 0, err
+		}
 
-	for _, systemWarrning := range systemWarrnings {
-		processor.Input(systemWarrning)
+		return mainContext.CurrentWorkingContextSize(), nil
+	default:
+		return 0, fmt.Errorf("unknown memory pressure kind %q", kind)
 	}
 }
@@ -0,0 +1,1193 @@
+package memory_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/memory/memorytest"
+	"github.com/Struki84/GoMemGPT/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tmc/langchaingo/llms"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// harness runs a processor on a fake model and a temporary database
+type harness struct {
+	t         *testing.T
+	path      string
+	model     *memorytest.Model
+	storage   storage.SqliteStorage
+	context   *memory.MemoryContext
+	processor *memory.LLMProcessor
+	outputs   chan string
+	turns     chan struct{}
+
+	// replies to turns nobody waits for, e.g. reminders and events
+	notifications chan string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newHarness(t *testing.T, path string, llm llms.Model, contextOpts []memory.ContextOption, opts ...memory.ProcessorOption) *harness {
+	t.Helper()
+
+	db := openStorage(t, path)
+	mainContext := memory.NewMemoryContext(db, contextOpts...)
+
+	notifications := make(chan string, 10)
+	opts = append(opts, memory.WithNotifications(func(msg llms.MessageContent) {
+		notifications <- memorytest.MessageText(msg)
+	}))
+
+	processor, err := memory.NewLLMProcessor(llm, mainContext, opts...)
+	if err != nil {
+		t.Fatalf("creating processor: %v", err)
+	}
+
+	h := &harness{
+		t:         t,
+		path:      path,
+		storage:   db,
+		context:   mainContext,
+		processor: processor,
+		outputs:   make(chan string, 10),
+		turns:     make(chan struct{}, 10),
+		done:      make(chan struct{}),
+
+		notifications: notifications,
+	}
+
+	// scripted models are checked by checkModel
+	if model, ok := llm.(*memorytest.Model); ok {
+		h.model = model
+	}
+
+	return h
+}
+
+// openStorage opens a database that is closed when the test ends
+func openStorage(t *testing.T, path string) storage.SqliteStorage {
+	t.Helper()
+
+	db := storage.NewSqliteStorage(storage.WithPath(path))
+	if db.DB == nil {
+		t.Fatalf("opening storage at %s failed", path)
+	}
+
+	t.Cleanup(func() {
+		sqlDB, err := db.DB.DB()
+		if err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	return db
+}
+
+func (h *harness) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer close(h.done)
+		h.processor.Run(ctx, wg)
+	}()
+
+	wg.Wait()
+	h.t.Cleanup(h.stop)
+}
+
+// stop waits for the processor loop to exit, the memory
+// context can be inspected safely afterwards
+func (h *harness) stop() {
+	if h.cancel == nil {
+		return
+	}
+
+	h.cancel()
+	<-h.done
+	h.cancel = nil
+}
+
+// say sends a user message the same way the agent does
+func (h *harness) say(text string) {
+	msg := llms.TextParts(llms.ChatMessageTypeHuman, text)
+
+	h.processor.Call(msg, func(msg llms.MessageContent) {
+		h.outputs <- memorytest.MessageText(msg)
+	}, func() {
+		h.turns <- struct{}{}
+	})
+}
+
+func (h *harness) waitOutput() string {
+	h.t.Helper()
+
+	select {
+	case output := <-h.outputs:
+		return output
+	case <-time.After(5 * time.Second):
+		h.t.Fatalf("no output")
+		return ""
+	}
+}
+
+func (h *harness) waitNotification() string {
+	h.t.Helper()
+
+	select {
+	case notification := <-h.notifications:
+		return notification
+	case <-time.After(5 * time.Second):
+		h.t.Fatalf("no notification")
+		return ""
+	}
+}
+
+// waitTurn waits until the processor is done with a message
+func (h *harness) waitTurn() {
+	h.t.Helper()
+
+	select {
+	case <-h.turns:
+	case <-time.After(5 * time.Second):
+		h.t.Fatalf("turn did not end")
+	}
+}
+
+func (h *harness) waitCall(model *memorytest.Model) {
+	h.t.Helper()
+
+	select {
+	case <-model.Called():
+	case <-time.After(5 * time.Second):
+		h.t.Fatalf("model was not called")
+	}
+}
+
+func (h *harness) checkModel(models ...*memorytest.Model) {
+	h.t.Helper()
+
+	for _, model := range append([]*memorytest.Model{h.model}, models...) {
+		if err := model.Err(); err != nil {
+			h.t.Errorf("model: %v", err)
+		}
+
+		if remaining := model.Remaining(); remaining > 0 {
+			h.t.Errorf("model has %d unused responses", remaining)
+		}
+	}
+}
+
+func dbPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "memory.db")
+}
+
+// contains asserts one of the messages contains the text
+func contains(role llms.ChatMessageType, text string) func([]llms.MessageContent) error {
+	return func(msgs []llms.MessageContent) error {
+		for _, msg := range msgs {
+			if msg.Role == role && strings.Contains(memorytest.MessageText(msg), text) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("no %s message containing %q", role, text)
+	}
+}
+
+// lastContains asserts the last message has the role and contains the text
+func lastContains(role llms.ChatMessageType, text string) func([]llms.MessageContent) error {
+	return func(msgs []llms.MessageContent) error {
+		last := msgs[len(msgs)-1]
+		if last.Role != role || !strings.Contains(memorytest.MessageText(last), text) {
+			return fmt.Errorf("last message is %s %q, want %s containing %q", last.Role, memorytest.MessageText(last), role, text)
+		}
+
+		return nil
+	}
+}
+
+func TestUserTurn(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.Text("Hi Ana!").
+			Expect(lastContains(llms.ChatMessageTypeHuman, "Hi, I'm Ana")).
+			Expect(contains(llms.ChatMessageTypeSystem, "<WORKING CONTEXT>")),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+	h.say("Hi, I'm Ana")
+
+	if output := h.waitOutput(); output != "Hi Ana!" {
+		t.Errorf("output = %q, want %q", output, "Hi Ana!")
+	}
+
+	h.stop()
+	h.checkModel()
+
+	tools := map[string]bool{}
+	for _, tool := range model.Calls()[0].Options.Tools {
+		tools[tool.Function.Name] = true
+	}
+
+	for _, name := range []string{"Memorize", "Recall", "ExternalOutput"} {
+		if !tools[name] {
+			t.Errorf("function %s was not offered to the model", name)
+		}
+	}
+}
+
+func TestToolChain(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Reflect", map[string]any{
+			"summary":           "User's name is Ana.",
+			"request_heartbeat": true,
+		}),
+		memorytest.ToolCall("ExternalOutput", map[string]any{"finalOutput": "Nice to meet you, Ana."}).
+			Expect(lastContains(llms.ChatMessageTypeSystem, "function Reflect requested a heartbeat")).
+			Expect(contains(llms.ChatMessageTypeSystem, "User's name is Ana.")),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+	h.say("Hi, I'm Ana")
+
+	if output := h.waitOutput(); output != "Nice to meet you, Ana." {
+		t.Errorf("output = %q, want %q", output, "Nice to meet you, Ana.")
+	}
+
+	h.stop()
+	h.checkModel()
+
+	if h.context.WorkingContext != "User's name is Ana." {
+		t.Errorf("working context = %q", h.context.WorkingContext)
+	}
+}
+
+func TestTurnWithoutReply(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Reflect", map[string]any{"summary": "User's name is Ana."}),
+		memorytest.Text("Hi again, Ana."),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+
+	// the function doesn't request a heartbeat, the turn ends without a reply
+	h.say("Hi, I'm Ana")
+	h.waitTurn()
+
+	select {
+	case output := <-h.outputs:
+		t.Errorf("unexpected output %q", output)
+	default:
+	}
+
+	h.say("Are you there?")
+	if output := h.waitOutput(); output != "Hi again, Ana." {
+		t.Errorf("output = %q, want %q", output, "Hi again, Ana.")
+	}
+
+	h.waitTurn()
+	h.stop()
+	h.checkModel()
+}
+
+func TestTurnWithTwoReplies(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("ExternalOutput", map[string]any{"finalOutput": "Let me check.", "request_heartbeat": true}),
+		memorytest.ToolCall("ExternalOutput", map[string]any{"finalOutput": "Your name is Ana."}).
+			Expect(lastContains(llms.ChatMessageTypeSystem, "function ExternalOutput requested a heartbeat")),
+		memorytest.Text("Bye, Ana."),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+
+	h.say("What's my name?")
+	for _, want := range []string{"Let me check.", "Your name is Ana."} {
+		if output := h.waitOutput(); output != want {
+			t.Errorf("output = %q, want %q", output, want)
+		}
+	}
+
+	h.waitTurn()
+
+	// the processor isn't blocked by the second reply
+	h.say("Bye")
+	if output := h.waitOutput(); output != "Bye, Ana." {
+		t.Errorf("output = %q, want %q", output, "Bye, Ana.")
+	}
+
+	h.waitTurn()
+	h.stop()
+	h.checkModel()
+}
+
+func TestEventNotification(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("ExternalOutput", map[string]any{"finalOutput": "The deploy finished."}).
+			Expect(lastContains(llms.ChatMessageTypeSystem, "webhook received from ci")),
+		memorytest.Text("Hi Ana."),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+
+	// nobody waits for a reply to the event
+	err := h.processor.Emit(memory.Event{
+		Type:    memory.EventWebhook,
+		Payload: map[string]any{"source": "ci", "status": "deployed"},
+	})
+
+	if err != nil {
+		t.Fatalf("emitting event: %v", err)
+	}
+
+	if notification := h.waitNotification(); notification != "The deploy finished." {
+		t.Errorf("notification = %q, want %q", notification, "The deploy finished.")
+	}
+
+	// the next user message gets its own reply
+	h.say("Hi, I'm Ana")
+	if output := h.waitOutput(); output != "Hi Ana." {
+		t.Errorf("output = %q, want %q", output, "Hi Ana.")
+	}
+
+	h.waitTurn()
+	h.stop()
+	h.checkModel()
+}
+
+func TestRegisterEventDuringTurn(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Reflect", map[string]any{"summary": "User's name is Ana.", "request_heartbeat": true}),
+		memorytest.Text("Nice to meet you, Ana."),
+		memorytest.Text("Noted.").
+			Expect(lastContains(llms.ChatMessageTypeSystem, "Deploy 42 finished")),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+	h.say("Hi, I'm Ana")
+
+	// the templates are registered while the turn renders its prompts
+	registered := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			err := h.processor.System.RegisterEvent("deploy", "Deploy {{.build}} finished.")
+			if err != nil {
+				registered <- err
+				return
+			}
+		}
+
+		registered <- nil
+	}()
+
+	h.waitTurn()
+
+	if err := <-registered; err != nil {
+		t.Fatalf("registering event: %v", err)
+	}
+
+	err := h.processor.Emit(memory.Event{Type: "deploy", Payload: map[string]any{"build": 42}})
+	if err != nil {
+		t.Fatalf("emitting event: %v", err)
+	}
+
+	h.waitNotification()
+	h.stop()
+	h.checkModel()
+}
+
+func TestMemorizeUnderPressure(t *testing.T) {
+	summarizer := memorytest.NewModel(
+		memorytest.Text("Ana is planning a trip to Rome in May.").
+			Expect(contains(llms.ChatMessageTypeHuman, "Evicted messages")),
+	)
+
+	model := memorytest.NewModel(
+		memorytest.Text("Rome it is.").
+			Expect(contains(llms.ChatMessageTypeSystem, "Ana is planning a trip to Rome in May.")),
+		memorytest.Text("Noted.").
+			Expect(lastContains(llms.ChatMessageTypeSystem, "Messages were full")),
+	)
+
+	h := newHarness(t, dbPath(t), model,
+		[]memory.ContextOption{memory.WithContextSize(600)},
+		memory.WithSummarizer(summarizer),
+	)
+
+	// fill short term memory past its budget
+	for i := 0; i < 12; i++ {
+		err := h.processor.System.AppendMessage(llms.TextParts(llms.ChatMessageTypeHuman,
+			fmt.Sprintf("Message %d: I'd like to plan a trip to Rome in May, somewhere close to the old town with good food and a view of the river.", i)))
+		if err != nil {
+			t.Fatalf("appending message: %v", err)
+		}
+	}
+
+	h.start()
+	h.say("Where should I go?")
+
+	for _, want := range []string{"Rome it is.", "Noted."} {
+		if output := h.waitOutput(); output != want {
+			t.Errorf("output = %q, want %q", output, want)
+		}
+	}
+
+	h.stop()
+	h.checkModel(summarizer)
+
+	if h.context.Summary != "Ana is planning a trip to Rome in May." {
+		t.Errorf("summary = %q", h.context.Summary)
+	}
+
+	recalled, err := h.storage.RecallMessages(memory.RecallQuery{Search: "trip to Rome"})
+	if err != nil {
+		t.Fatalf("recalling messages: %v", err)
+	}
+
+	if recalled.Total == 0 {
+		t.Errorf("no messages were archived")
+	}
+}
+
+func TestRecall(t *testing.T) {
+	path := dbPath(t)
+
+	db := storage.NewSqliteStorage(storage.WithPath(path))
+	archived := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "My favourite colour is teal."),
+		llms.TextParts(llms.ChatMessageTypeAI, "Teal is a great colour."),
+	}
+
+	if err := db.SaveMessages(archived); err != nil {
+		t.Fatalf("saving messages: %v", err)
+	}
+
+	if err := db.ArchiveMessages(archived); err != nil {
+		t.Fatalf("archiving messages: %v", err)
+	}
+
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Recall", map[string]any{
+			"search":            "colour",
+			"request_heartbeat": true,
+		}),
+		memorytest.Text("Your favourite colour is teal.").
+			Expect(contains(llms.ChatMessageTypeSystem, "My favourite colour is teal.")).
+			Expect(contains(llms.ChatMessageTypeTool, "showing 2 of 2 messages")),
+	)
+
+	h := newHarness(t, path, model, nil)
+	h.start()
+	h.say("What's my favourite colour?")
+
+	if output := h.waitOutput(); output != "Your favourite colour is teal." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.stop()
+	h.checkModel()
+}
+
+func TestRecallDateRange(t *testing.T) {
+	path := dbPath(t)
+
+	db := storage.NewSqliteStorage(storage.WithPath(path))
+	archived := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "Let's meet on Friday."),
+		llms.TextParts(llms.ChatMessageTypeAI, "Friday works."),
+	}
+
+	if err := db.SaveMessages(archived); err != nil {
+		t.Fatalf("saving messages: %v", err)
+	}
+
+	if err := db.ArchiveMessages(archived); err != nil {
+		t.Fatalf("archiving messages: %v", err)
+	}
+
+	// the range is given in a time zone ahead of UTC
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	now := time.Now().In(zone)
+
+	model := memorytest.NewModel(
+		memorytest.ToolCall("conversation_search_date", map[string]any{
+			"start":             now.Add(-time.Hour).Format(time.RFC3339),
+			"end":               now.Add(time.Hour).Format(time.RFC3339),
+			"request_heartbeat": true,
+		}),
+		memorytest.ToolCall("conversation_search_date", map[string]any{
+			"start":             now.Add(-3 * time.Hour).Format(time.RFC3339),
+			"end":               now.Add(-2 * time.Hour).Format(time.RFC3339),
+			"request_heartbeat": true,
+		}).Expect(contains(llms.ChatMessageTypeTool, "showing 2 of 2 messages")),
+		memorytest.Text("We agreed to meet on Friday.").
+			Expect(lastContains(llms.ChatMessageTypeSystem, "conversation_search_date requested a heartbeat")).
+			Expect(func(msgs []llms.MessageContent) error {
+				// the earlier range found nothing
+				for i := len(msgs) - 1; i >= 0; i-- {
+					if msgs[i].Role == llms.ChatMessageTypeTool {
+						return contains(llms.ChatMessageTypeTool, "No messages found")(msgs[i:])
+					}
+				}
+
+				return errors.New("no tool message")
+			}),
+	)
+
+	h := newHarness(t, path, model, nil)
+	h.start()
+	h.say("What did we agree on today?")
+
+	if output := h.waitOutput(); output != "We agreed to meet on Friday." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.stop()
+	h.checkModel()
+}
+
+func TestRecallTags(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Tag", map[string]any{
+			"message":           "flight to Rome",
+			"tags":              []string{"Travel", " trip "},
+			"request_heartbeat": true,
+		}),
+		memorytest.Text("Tagged.").
+			Expect(contains(llms.ChatMessageTypeTool, "Message tagged")),
+		memorytest.ToolCall("Recall", map[string]any{
+			"tags":              []string{"travel"},
+			"request_heartbeat": true,
+		}),
+		memorytest.ToolCall("Recall", map[string]any{
+			"tags":              []string{"%"},
+			"request_heartbeat": true,
+		}).
+			Expect(contains(llms.ChatMessageTypeTool, "showing 1 of 1 messages")).
+			Expect(contains(llms.ChatMessageTypeSystem, "Book the flight to Rome. [tags: travel, trip]")),
+		memorytest.Text("You wanted to book a flight to Rome.").
+			Expect(func(msgs []llms.MessageContent) error {
+				// wildcards match no tag
+				for i := len(msgs) - 1; i >= 0; i-- {
+					if msgs[i].Role == llms.ChatMessageTypeTool {
+						return contains(llms.ChatMessageTypeTool, "No messages found")(msgs[i:])
+					}
+				}
+
+				return errors.New("no tool message")
+			}),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+
+	for _, text := range []string{"Book the flight to Rome.", "The deploy is broken."} {
+		if err := h.processor.System.AppendMessage(llms.TextParts(llms.ChatMessageTypeHuman, text)); err != nil {
+			t.Fatalf("appending message: %v", err)
+		}
+	}
+
+	h.start()
+	h.say("Remember my travel plans.")
+	if output := h.waitOutput(); output != "Tagged." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.waitTurn()
+
+	// the tagged message is moved to long term memory
+	var err error
+	h.processor.Do(func(ctx context.Context) {
+		err = h.processor.Operator().Reset()
+	})
+
+	if err != nil {
+		t.Fatalf("resetting memory: %v", err)
+	}
+
+	h.say("What were my travel plans?")
+	if output := h.waitOutput(); output != "You wanted to book a flight to Rome." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.stop()
+	h.checkModel()
+}
+
+func TestRestart(t *testing.T) {
+	path := dbPath(t)
+
+	first := memorytest.NewModel(
+		memorytest.ToolCall("Reflect", map[string]any{"summary": "User's name is Ana."}).
+			ToolCall("Save", map[string]any{}).
+			ToolCall("ExternalOutput", map[string]any{"finalOutput": "Nice to meet you, Ana."}),
+	)
+
+	h := newHarness(t, path, first, nil)
+	h.start()
+	h.say("Hi, I'm Ana")
+	h.waitOutput()
+	h.stop()
+	h.checkModel()
+
+	second := memorytest.NewModel(
+		memorytest.Text("Welcome back, Ana.").
+			Expect(contains(llms.ChatMessageTypeHuman, "Hi, I'm Ana")).
+			Expect(contains(llms.ChatMessageTypeSystem, "User's name is Ana.")),
+	)
+
+	h = newHarness(t, path, second, nil)
+
+	if h.context.WorkingContext != "User's name is Ana." {
+		t.Errorf("reloaded working context = %q", h.context.WorkingContext)
+	}
+
+	h.start()
+	h.say("I'm back")
+
+	if output := h.waitOutput(); output != "Welcome back, Ana." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.stop()
+	h.checkModel()
+}
+
+func TestReset(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.Text("Nice to meet you, Ana."),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+	h.say("Hi, I'm Ana")
+	h.waitOutput()
+
+	var err error
+	var stats memory.MessageStats
+
+	// runs between messages on the processor's goroutine
+	h.processor.Do(func(ctx context.Context) {
+		err = h.processor.Operator().Reset()
+		stats, _ = h.storage.MessageStats()
+	})
+
+	h.stop()
+	h.checkModel()
+
+	if err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+
+	if queue := h.context.Queue(); len(queue) != 0 {
+		t.Errorf("queue has %d messages after reset", len(queue))
+	}
+
+	if stats.Archived != 2 {
+		t.Errorf("archived messages = %d, want 2", stats.Archived)
+	}
+}
+
+func TestModelError(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.Error(errors.New("rate limited")),
+		memorytest.Text("I'm back."),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+
+	h.say("Hello?")
+	h.waitCall(model)
+
+	h.say("Hello again?")
+
+	if output := h.waitOutput(); output != "I'm back." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.stop()
+	h.checkModel()
+}
+
+func TestModelNoChoices(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.Empty(),
+		memorytest.Text("I'm back."),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+
+	h.say("Hello?")
+	h.waitCall(model)
+
+	h.say("Hello again?")
+
+	if output := h.waitOutput(); output != "I'm back." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.stop()
+	h.checkModel()
+}
+
+func TestFunctionError(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Forget", map[string]any{}),
+		memorytest.Text("Sorry, I can't do that.").
+			Expect(lastContains(llms.ChatMessageTypeSystem, "function Forget failed")).
+			Expect(contains(llms.ChatMessageTypeTool, "unknown function: Forget")),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil)
+	h.start()
+	h.say("Forget everything")
+
+	if output := h.waitOutput(); output != "Sorry, I can't do that." {
+		t.Errorf("output = %q", output)
+	}
+
+	h.stop()
+	h.checkModel()
+}
+
+func TestLogging(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Think", map[string]any{"thought": "Greet Ana.", "request_heartbeat": true}).Usage(120, 15),
+		memorytest.Text("Hi Ana!").Usage(160, 5),
+	)
+
+	out := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	h := newHarness(t, dbPath(t), model, nil, memory.WithLogger(logger))
+	h.start()
+	h.say("Hi, I'm Ana")
+	h.waitOutput()
+	h.stop()
+	h.checkModel()
+
+	records := map[string][]map[string]any{}
+
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		record := map[string]any{}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("decoding log record: %v", err)
+		}
+
+		msg := record["msg"].(string)
+		records[msg] = append(records[msg], record)
+	}
+
+	calls := records["model called"]
+	if len(calls) != 2 {
+		t.Fatalf("logged %d model calls, want 2", len(calls))
+	}
+
+	for i, want := range []map[string]float64{
+		{"turn": 1, "step": 1, "prompt_tokens": 120, "completion_tokens": 15, "function_calls": 1},
+		{"turn": 1, "step": 2, "prompt_tokens": 160, "completion_tokens": 5, "function_calls": 0},
+	} {
+		for key, value := range want {
+			if calls[i][key] != value {
+				t.Errorf("model call %d: %s = %v, want %v", i+1, key, calls[i][key], value)
+			}
+		}
+	}
+
+	functions := records["function called"]
+	if len(functions) != 1 || functions[0]["function"] != "Think" || functions[0]["step"] != 1.0 {
+		t.Errorf("function calls = %v", functions)
+	}
+
+	if len(records["handling message"]) == 0 {
+		t.Error("no debug records of the handled messages")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Reflect", map[string]any{"summary": "User's name is Ana.", "request_heartbeat": true}).Usage(120, 15),
+		memorytest.Text("Nice to meet you, Ana.").Usage(160, 5),
+	)
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	h := newHarness(t, dbPath(t), model, nil,
+		memory.WithTracerProvider(provider),
+		memory.WithModelName("gpt-test"),
+	)
+
+	h.start()
+	h.say("Hi, I'm Ana")
+	h.waitOutput()
+	h.stop()
+	h.checkModel()
+
+	spans := map[string][]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+
+	if len(spans["turn"]) != 1 {
+		t.Fatalf("recorded %d turns, want 1", len(spans["turn"]))
+	}
+
+	turn := spans["turn"][0]
+	if steps := attributeValue(turn, "steps"); steps.AsInt64() != 2 {
+		t.Errorf("turn has %d steps, want 2", steps.AsInt64())
+	}
+
+	chats := spans["chat gpt-test"]
+	if len(chats) != 2 {
+		t.Fatalf("recorded %d model calls, want 2", len(chats))
+	}
+
+	for i, tokens := range [][2]int64{{120, 15}, {160, 5}} {
+		if chats[i].Parent.SpanID() != turn.SpanContext.SpanID() {
+			t.Errorf("model call %d is not a child of the turn", i+1)
+		}
+
+		input := attributeValue(chats[i], "gen_ai.usage.input_tokens").AsInt64()
+		output := attributeValue(chats[i], "gen_ai.usage.output_tokens").AsInt64()
+		if input != tokens[0] || output != tokens[1] {
+			t.Errorf("model call %d used %d/%d tokens, want %d/%d", i+1, input, output, tokens[0], tokens[1])
+		}
+	}
+
+	functions := spans["execute_tool Reflect"]
+	if len(functions) != 1 || functions[0].Parent.SpanID() != turn.SpanContext.SpanID() {
+		t.Fatalf("Reflect spans = %v, want a single child of the turn", functions)
+	}
+
+	saves := spans["storage SaveWorkingContext"]
+	if len(saves) != 1 || saves[0].Parent.SpanID() != functions[0].SpanContext.SpanID() {
+		t.Errorf("working context saves = %v, want a single child of Reflect", saves)
+	}
+
+	// the stats are collected once per model call, not on every append
+	stats := spans["storage MessageStats"]
+	if len(stats) != 2 {
+		t.Fatalf("recorded %d message stats queries, want 2", len(stats))
+	}
+
+	for i, span := range stats {
+		if span.Parent.SpanID() != chats[i].SpanContext.SpanID() {
+			t.Errorf("message stats query %d is not a child of model call %d", i+1, i+1)
+		}
+	}
+}
+
+func attributeValue(span tracetest.SpanStub, key string) attribute.Value {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+func TestUsage(t *testing.T) {
+	summarizer := memorytest.NewModel(
+		memorytest.Text("Ana is planning a trip to Rome."),
+	)
+
+	model := memorytest.NewModel(
+		memorytest.ToolCall("Memorize", map[string]any{"request_heartbeat": true}).Usage(400, 10),
+		memorytest.Text("Done."),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil,
+		memory.WithModelName("gpt-4o"),
+		memory.WithSummarizer(memory.NamedModel(summarizer, "gpt-4o-mini")),
+	)
+
+	for i := 0; i < 6; i++ {
+		err := h.processor.System.AppendMessage(llms.TextParts(llms.ChatMessageTypeHuman, fmt.Sprintf("Message %d about the trip to Rome.", i)))
+		if err != nil {
+			t.Fatalf("appending message: %v", err)
+		}
+	}
+
+	h.start()
+	h.say("Please memorize this.")
+	h.waitOutput()
+	h.stop()
+	h.checkModel(summarizer)
+
+	report, err := h.processor.Usage(memory.UsageQuery{})
+	if err != nil {
+		t.Fatalf("loading usage: %v", err)
+	}
+
+	totals := map[memory.UsagePurpose]memory.UsageTotal{}
+	for _, total := range report.Totals {
+		totals[total.Purpose] = total
+	}
+
+	chat := totals[memory.UsageChat]
+	if chat.Model != "gpt-4o" || chat.Calls != 2 || chat.Estimated != 1 {
+		t.Errorf("chat usage = %+v, want 2 gpt-4o calls with 1 estimated", chat)
+	}
+
+	// the second call reported no usage and was counted locally
+	if chat.PromptTokens <= 400 || chat.CompletionTokens <= 10 {
+		t.Errorf("chat tokens = %d/%d, want more than the reported 400/10", chat.PromptTokens, chat.CompletionTokens)
+	}
+
+	summary := totals[memory.UsageSummarization]
+	if summary.Model != "gpt-4o-mini" || summary.Calls != 1 || summary.Estimated != 1 || summary.PromptTokens == 0 {
+		t.Errorf("summarization usage = %+v, want 1 estimated gpt-4o-mini call", summary)
+	}
+
+	want := memory.DefaultPricing["gpt-4o"].Cost(chat.PromptTokens, chat.CompletionTokens) +
+		memory.DefaultPricing["gpt-4o-mini"].Cost(summary.PromptTokens, summary.CompletionTokens)
+
+	if math.Abs(report.Cost-want) > 1e-9 || len(report.Unpriced) > 0 {
+		t.Errorf("cost = %f unpriced %v, want %f", report.Cost, report.Unpriced, want)
+	}
+
+	other, err := h.processor.Usage(memory.UsageQuery{Session: "session-2"})
+	if err != nil || len(other.Totals) > 0 {
+		t.Errorf("other session usage = %+v, %v", other.Totals, err)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.Text("Hi Ana.").Usage(120, 5),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil,
+		memory.WithSessionLimits(memory.Limits{TokensPerDay: 100}),
+	)
+
+	h.start()
+	h.say("Hi, I'm Ana.")
+	if output := h.waitOutput(); output != "Hi Ana." {
+		t.Fatalf("output = %q, want Hi Ana.", output)
+	}
+
+	// the model is not called once the limit is reached
+	for i := 0; i < 2; i++ {
+		h.say("Are you there?")
+		if output := h.waitOutput(); !strings.Contains(output, "125 tokens today") {
+			t.Errorf("output = %q, want usage limit message", output)
+		}
+	}
+
+	// nobody is told when an event is blocked
+	err := h.processor.Emit(memory.Event{Type: memory.EventUserLogin, Payload: map[string]any{"user": "Ana"}})
+	if err != nil {
+		t.Fatalf("emitting event: %v", err)
+	}
+
+	h.say("Hello?")
+	if output := h.waitOutput(); !strings.Contains(output, "125 tokens today") {
+		t.Errorf("output = %q, want usage limit message", output)
+	}
+
+	select {
+	case notification := <-h.notifications:
+		t.Errorf("unexpected notification %q", notification)
+	default:
+	}
+
+	h.stop()
+	h.checkModel()
+
+	// the agent is told once
+	notices := 0
+	for _, msg := range h.context.Messages {
+		if msg.Role == llms.ChatMessageTypeSystem && strings.Contains(memorytest.MessageText(msg), "Usage limit") {
+			notices++
+		}
+	}
+
+	if notices != 1 {
+		t.Errorf("usage limit system messages = %d, want 1", notices)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	model := memorytest.NewModel(
+		memorytest.ToolCall("archival_memory_search", map[string]any{"query": "Rome", "request_heartbeat": true}),
+		memorytest.ToolCall("Pin", map[string]any{"message": "a message that was never sent"}),
+		memorytest.Text("I couldn't find anything about Rome."),
+	)
+
+	registry := prometheus.NewRegistry()
+	h := newHarness(t, dbPath(t), model, nil, memory.WithMetrics(registry))
+
+	h.start()
+	h.say("What did I say about Rome?")
+	h.waitOutput()
+	h.stop()
+	h.checkModel()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"gomemgpt_turns_total", map[string]string{"trigger": "human"}, 1},
+		{"gomemgpt_tool_calls_total", map[string]string{"function": "archival_memory_search", "outcome": "ok"}, 1},
+		{"gomemgpt_tool_calls_total", map[string]string{"function": "Pin", "outcome": "error"}, 1},
+		{"gomemgpt_recalls_total", map[string]string{"memory": "archival", "outcome": "miss"}, 1},
+		{"gomemgpt_llm_request_duration_seconds", map[string]string{"outcome": "ok"}, 3},
+		{"gomemgpt_queue_depth", nil, 0},
+	} {
+		value, ok := metricValue(families, tc.name, tc.labels)
+		if !ok || value != tc.want {
+			t.Errorf("%s%v = %v (found %v), want %v", tc.name, tc.labels, value, ok, tc.want)
+		}
+	}
+
+	utilization, ok := metricValue(families, "gomemgpt_context_utilization_ratio", map[string]string{"section": "messages"})
+	if !ok || utilization <= 0 || utilization >= 1 {
+		t.Errorf("messages utilization = %v (found %v), want between 0 and 1", utilization, ok)
+	}
+}
+
+// metricValue returns the value of the series with the labels,
+// histograms return their sample count
+func metricValue(families []*dto.MetricFamily, name string, labels map[string]string) (float64, bool) {
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, metric := range family.GetMetric() {
+			values := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				values[label.GetName()] = label.GetValue()
+			}
+
+			for key, value := range labels {
+				if values[key] != value {
+					continue metrics
+				}
+			}
+
+			switch {
+			case metric.Counter != nil:
+				return metric.GetCounter().GetValue(), true
+			case metric.Gauge != nil:
+				return metric.GetGauge().GetValue(), true
+			case metric.Histogram != nil:
+				return float64(metric.GetHistogram().GetSampleCount()), true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	db := storage.NewSqliteStorage(storage.WithPath(dbPath(t)))
+
+	_, err := memory.NewLLMProcessor(memorytest.NewModel(), memory.NewMemoryContext(db),
+		memory.WithSystemOptions(memory.WithTemplate("primer:assistantTemplate", "{{.persona}}")),
+	)
+
+	if err == nil || !strings.Contains(err.Error(), "workingContext") {
+		t.Errorf("err = %v, want missing workingContext error", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	recorder := memorytest.NewRecorder(memorytest.NewModel(
+		memorytest.ToolCall("Reflect", map[string]any{
+			"summary":           "User's name is Ana.",
+			"request_heartbeat": true,
+		}),
+		memorytest.ToolCall("ExternalOutput", map[string]any{"finalOutput": "Nice to meet you, Ana."}),
+	), cassette)
+
+	session := func(llm llms.Model, opts ...memory.ProcessorOption) (string, error) {
+		h := newHarness(t, dbPath(t), llm, nil, opts...)
+		h.start()
+		defer h.stop()
+
+		h.say("Hi, I'm Ana")
+
+		select {
+		case output := <-h.outputs:
+			return output, nil
+		case <-time.After(time.Second):
+			return "", errors.New("no output")
+		}
+	}
+
+	recorded, err := session(recorder)
+	if err != nil {
+		t.Fatalf("recording: %v", err)
+	}
+
+	tape, err := memorytest.LoadCassette(cassette)
+	if err != nil {
+		t.Fatalf("loading cassette: %v", err)
+	}
+
+	replayer := memorytest.NewReplayer(tape)
+
+	replayed, err := session(replayer)
+	if err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+
+	if replayed != recorded {
+		t.Errorf("replayed output = %q, recorded %q", replayed, recorded)
+	}
+
+	if err := replayer.Err(); err != nil {
+		t.Errorf("replay drifted: %v", err)
+	}
+
+	if remaining := replayer.Remaining(); remaining != 0 {
+		t.Errorf("%d interactions were not replayed", remaining)
+	}
+
+	// a changed prompt is reported as drift
+	drifting := memorytest.NewReplayer(tape)
+	session(drifting, memory.WithSystemOptions(memory.WithPersona("You are a pirate.")))
+
+	if err := drifting.Err(); !errors.Is(err, memorytest.ErrDrift) {
+		t.Errorf("err = %v, want drift", err)
+	}
+}
@@ -0,0 +1,102 @@
+package memory
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// default number of messages returned per recall page
+var recallPageSize = 10
+
+// RecallQuery filters the messages archived in recall memory,
+// zero values are ignored.
+type RecallQuery struct {
+	// Substring the message content must contain
+	Search string
+
+	// Roles to search, defaults to the conversation
+	// between the user and the agent (human and ai)
+	Roles []llms.ChatMessageType
+
+	// Messages created within the date range
+	Start time.Time
+	End   time.Time
+
+	// Session to search, defaults to the current session
+	Session string
+
+	// Tags the message must have, set with the Tag function
+	Tags []string
+
+	Limit  int
+	Offset int
+}
+
+// RecallResult holds a page of recalled messages and the
+// total number of messages matching the query.
+type RecallResult struct {
+	Messages []RecalledMessage
+	Total    int
+}
+
+type RecalledMessage struct {
+	ID        uint
+	Role      llms.ChatMessageType
+	Content   string
+	Session   string
+	Tags      []string
+	CreatedAt time.Time
+}
+
+func (msg RecalledMessage) String() string {
+	result := msg.CreatedAt.Local().Format("2006-01-02 15:04:05") + ": " + string(msg.Role) + " - " + msg.Content
+	if len(msg.Tags) > 0 {
+		result += " [tags: " + strings.Join(msg.Tags, ", ") + "]"
+	}
+
+	return result
+}
+
+// NormalizeTags lowercases and trims the tags and drops empty
+// and duplicate ones, commas separate the stored tags.
+func NormalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(strings.ReplaceAll(tag, ",", " ")))
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	return normalized
+}
+
+// parseRecallDate accepts dates in RFC3339 or 2006-01-02 format,
+// date only values are expanded to the end of the day when end is set.
+func parseRecallDate(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if end {
+		date = date.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	return date, nil
+}
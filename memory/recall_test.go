@@ -0,0 +1,29 @@
+package memory_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestRecallLocalTime(t *testing.T) {
+	// the storage keeps the timestamps in UTC
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	createdAt := time.Date(2024, 5, 6, 22, 30, 0, 0, time.UTC)
+
+	msg := memory.RecalledMessage{Role: llms.ChatMessageTypeHuman, Content: "Let's meet on Tuesday.", CreatedAt: createdAt}
+	if text := msg.String(); !strings.HasPrefix(text, "2024-05-07 03:30:00") {
+		t.Errorf("recalled message = %q, want the local time", text)
+	}
+
+	stats := memory.MemoryStats{Messages: memory.MessageStats{Archived: 1, Oldest: createdAt, Newest: createdAt}}
+	if text := stats.String(); !strings.Contains(text, "from 2024-05-07 03:30") {
+		t.Errorf("stats = %q, want the local time", text)
+	}
+}
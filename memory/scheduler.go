@@ -0,0 +1,296 @@
+package memory
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Clock abstracts time so the scheduler can be driven by tests.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer fires once on C after its duration, it is reused with Reset.
+type Timer interface {
+	C() <-chan time.Time
+	// Reset drops a tick nobody received and fires after d
+	Reset(d time.Duration)
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (timer systemTimer) C() <-chan time.Time {
+	return timer.Timer.C
+}
+
+func (timer systemTimer) Reset(d time.Duration) {
+	// before go1.23 a stopped timer keeps its unreceived tick
+	if !timer.Timer.Stop() {
+		select {
+		case <-timer.Timer.C:
+		default:
+		}
+	}
+
+	timer.Timer.Reset(d)
+}
+
+func (timer systemTimer) Stop() {
+	timer.Timer.Stop()
+}
+
+// Reminder is a note the agent scheduled for itself,
+// reminders are persisted so they survive restarts.
+type Reminder struct {
+	ID   uint
+	At   time.Time
+	Note string
+}
+
+// ScheduledEvent is a due job or reminder, injected into
+// the processor as a system event.
+type ScheduledEvent struct {
+	Note     string
+	Reminder bool
+	At       time.Time
+}
+
+type scheduledJob struct {
+	schedule cron.Schedule
+	note     string
+	next     time.Time
+}
+
+// Scheduler wakes the processor on cron/interval schedules
+// and on reminders the agent set for itself.
+type Scheduler struct {
+	clock   Clock
+	storage MemoryStorage
+	logger  *slog.Logger
+
+	mu        sync.Mutex
+	jobs      []*scheduledJob
+	reminders []Reminder
+	changed   chan struct{}
+
+	// a single timer is reset for the next due time, timers
+	// created per wait would stay alive until they fire
+	timer Timer
+	armed bool
+}
+
+func NewScheduler(storage MemoryStorage, clock Clock) *Scheduler {
+	return &Scheduler{
+		clock:   clock,
+		storage: storage,
+		logger:  NopLogger(),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Load reads the pending reminders from storage.
+func (scheduler *Scheduler) Load() error {
+	reminders, err := scheduler.storage.LoadReminders()
+	if err != nil {
+		return err
+	}
+
+	scheduler.mu.Lock()
+	scheduler.reminders = reminders
+	scheduler.mu.Unlock()
+
+	scheduler.notify()
+
+	return nil
+}
+
+// Schedule injects the note as a system event on a cron schedule,
+// intervals are supported with the "@every 1h" descriptor.
+func (scheduler *Scheduler) Schedule(spec string, note string) error {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q: %w", spec, err)
+	}
+
+	scheduler.mu.Lock()
+	scheduler.jobs = append(scheduler.jobs, &scheduledJob{
+		schedule: schedule,
+		note:     note,
+		next:     schedule.Next(scheduler.clock.Now()),
+	})
+	scheduler.mu.Unlock()
+
+	scheduler.notify()
+
+	return nil
+}
+
+// Remind persists a reminder and wakes the processor at the given time.
+func (scheduler *Scheduler) Remind(at time.Time, note string) (Reminder, error) {
+	reminder, err := scheduler.storage.SaveReminder(Reminder{At: at, Note: note})
+	if err != nil {
+		return Reminder{}, err
+	}
+
+	scheduler.mu.Lock()
+	scheduler.reminders = append(scheduler.reminders, reminder)
+	scheduler.mu.Unlock()
+
+	scheduler.notify()
+
+	return reminder, nil
+}
+
+// Timer fires when the next job or reminder is due, the returned
+// channel is nil (blocks forever) when nothing is scheduled.
+// The timer is moved by Due and Reschedule.
+func (scheduler *Scheduler) Timer() <-chan time.Time {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if scheduler.timer == nil {
+		scheduler.reschedule()
+	}
+
+	if !scheduler.armed {
+		return nil
+	}
+
+	return scheduler.timer.C()
+}
+
+// Reschedule moves the timer to the next job or reminder,
+// call it when Changed fires.
+func (scheduler *Scheduler) Reschedule() {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	scheduler.reschedule()
+}
+
+func (scheduler *Scheduler) reschedule() {
+	next := time.Time{}
+	for _, job := range scheduler.jobs {
+		if next.IsZero() || job.next.Before(next) {
+			next = job.next
+		}
+	}
+
+	for _, reminder := range scheduler.reminders {
+		if next.IsZero() || reminder.At.Before(next) {
+			next = reminder.At
+		}
+	}
+
+	if next.IsZero() {
+		if scheduler.timer != nil {
+			scheduler.timer.Stop()
+		}
+
+		scheduler.armed = false
+		return
+	}
+
+	wait := next.Sub(scheduler.clock.Now())
+	if scheduler.timer == nil {
+		scheduler.timer = scheduler.clock.NewTimer(wait)
+	} else {
+		scheduler.timer.Reset(wait)
+	}
+
+	scheduler.armed = true
+}
+
+// Changed signals that jobs or reminders were added and the
+// timer returned by Timer has to be rescheduled.
+func (scheduler *Scheduler) Changed() <-chan struct{} {
+	return scheduler.changed
+}
+
+// Due returns the events that are due and advances the jobs and
+// the timer, due reminders are completed in storage.
+func (scheduler *Scheduler) Due() []ScheduledEvent {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	now := scheduler.clock.Now()
+	events := []ScheduledEvent{}
+
+	for _, job := range scheduler.jobs {
+		if job.next.After(now) {
+			continue
+		}
+
+		events = append(events, ScheduledEvent{Note: job.note, At: job.next})
+		job.next = job.schedule.Next(now)
+	}
+
+	pending := []Reminder{}
+	for _, reminder := range scheduler.reminders {
+		if reminder.At.After(now) {
+			pending = append(pending, reminder)
+			continue
+		}
+
+		err := scheduler.storage.CompleteReminder(reminder.ID)
+		if err != nil {
+			scheduler.logger.Error("completing reminder", "reminder", reminder.ID, "error", err)
+		}
+
+		events = append(events, ScheduledEvent{Note: reminder.Note, Reminder: true, At: reminder.At})
+	}
+
+	scheduler.reminders = pending
+	scheduler.reschedule()
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At.Before(events[j].At)
+	})
+
+	return events
+}
+
+// parseReminderTime accepts RFC3339 timestamps, "2006-01-02 15:04"
+// local times and durations relative to now (e.g. 30m, 2h).
+func parseReminderTime(value string, now time.Time) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(duration), nil
+	}
+
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+
+	at, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid reminder time %q, use RFC3339, YYYY-MM-DD HH:MM or a duration like 30m", value)
+	}
+
+	return at, nil
+}
+
+func (scheduler *Scheduler) notify() {
+	select {
+	case scheduler.changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,203 @@
+package memory_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/memory/memorytest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func notes(events []memory.ScheduledEvent) []string {
+	result := []string{}
+	for _, event := range events {
+		result = append(result, event.Note)
+	}
+
+	return result
+}
+
+func TestSchedulerCron(t *testing.T) {
+	clock := memorytest.NewClock(time.Date(2024, 5, 6, 8, 0, 0, 0, time.UTC))
+	scheduler := memory.NewScheduler(openStorage(t, dbPath(t)), clock)
+
+	if err := scheduler.Schedule("0 9 * * *", "Morning check-in"); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+
+	if err := scheduler.Schedule("@every 2h", "Review open tasks"); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+
+	if err := scheduler.Schedule("every morning", "Invalid"); err == nil {
+		t.Error("invalid schedule was accepted")
+	}
+
+	timer := scheduler.Timer()
+	if due := scheduler.Due(); len(due) != 0 {
+		t.Errorf("due at 8:00 = %v, want nothing", notes(due))
+	}
+
+	clock.Advance(time.Hour)
+
+	select {
+	case <-timer:
+	default:
+		t.Error("timer didn't fire at 9:00")
+	}
+
+	if due := notes(scheduler.Due()); len(due) != 1 || due[0] != "Morning check-in" {
+		t.Errorf("due at 9:00 = %v, want the morning check-in", due)
+	}
+
+	clock.Advance(time.Hour)
+
+	if due := notes(scheduler.Due()); len(due) != 1 || due[0] != "Review open tasks" {
+		t.Errorf("due at 10:00 = %v, want the task review", due)
+	}
+
+	// missed runs are delivered once, in order
+	clock.Advance(23 * time.Hour)
+
+	due := notes(scheduler.Due())
+	if len(due) != 2 || due[0] != "Review open tasks" || due[1] != "Morning check-in" {
+		t.Errorf("due the next day at 9:00 = %v, want the task review and the check-in", due)
+	}
+}
+
+func TestSchedulerReminder(t *testing.T) {
+	clock := memorytest.NewClock(time.Date(2024, 5, 6, 8, 0, 0, 0, time.UTC))
+	db := openStorage(t, dbPath(t))
+	scheduler := memory.NewScheduler(db, clock)
+
+	if timer := scheduler.Timer(); timer != nil {
+		t.Error("timer is set with nothing scheduled")
+	}
+
+	_, err := scheduler.Remind(clock.Now().Add(30*time.Minute), "Call Ana")
+	if err != nil {
+		t.Fatalf("reminding: %v", err)
+	}
+
+	clock.Advance(29 * time.Minute)
+	if due := scheduler.Due(); len(due) != 0 {
+		t.Errorf("due before the reminder = %v", notes(due))
+	}
+
+	clock.Advance(time.Minute)
+
+	due := scheduler.Due()
+	if len(due) != 1 || due[0].Note != "Call Ana" || !due[0].Reminder {
+		t.Fatalf("due = %+v, want the reminder", due)
+	}
+
+	// a reminder fires once and is completed in storage
+	clock.Advance(time.Hour)
+	if due := scheduler.Due(); len(due) != 0 {
+		t.Errorf("reminder fired again: %v", notes(due))
+	}
+
+	pending, err := db.LoadReminders()
+	if err != nil || len(pending) != 0 {
+		t.Errorf("pending reminders = %v, %v, want none", pending, err)
+	}
+}
+
+func TestSchedulerReload(t *testing.T) {
+	clock := memorytest.NewClock(time.Date(2024, 5, 6, 8, 0, 0, 0, time.UTC))
+	path := dbPath(t)
+
+	_, err := memory.NewScheduler(openStorage(t, path), clock).Remind(clock.Now().Add(time.Hour), "Send the report")
+	if err != nil {
+		t.Fatalf("reminding: %v", err)
+	}
+
+	// the agent restarts before the reminder is due
+	scheduler := memory.NewScheduler(openStorage(t, path), clock)
+	if err := scheduler.Load(); err != nil {
+		t.Fatalf("loading reminders: %v", err)
+	}
+
+	clock.Advance(time.Hour)
+
+	if due := notes(scheduler.Due()); len(due) != 1 || due[0] != "Send the report" {
+		t.Errorf("due after reload = %v, want the report reminder", due)
+	}
+}
+
+func TestReminderNotification(t *testing.T) {
+	clock := memorytest.NewClock(time.Date(2024, 5, 6, 8, 0, 0, 0, time.UTC))
+
+	model := memorytest.NewModel(
+		memorytest.Text("Time to call Ana.").
+			Expect(lastContains(llms.ChatMessageTypeSystem, "Call Ana")),
+		memorytest.Text("You're welcome."),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil, memory.WithClock(clock))
+
+	_, err := h.processor.Scheduler.Remind(clock.Now().Add(time.Minute), "Call Ana")
+	if err != nil {
+		t.Fatalf("reminding: %v", err)
+	}
+
+	h.start()
+	clock.Advance(time.Minute)
+
+	// nobody called the agent, the reply is a notification
+	if notification := h.waitNotification(); notification != "Time to call Ana." {
+		t.Errorf("notification = %q, want %q", notification, "Time to call Ana.")
+	}
+
+	h.say("Thanks")
+	if output := h.waitOutput(); output != "You're welcome." {
+		t.Errorf("output = %q, want %q", output, "You're welcome.")
+	}
+
+	h.waitTurn()
+	h.stop()
+	h.checkModel()
+}
+
+func TestSchedulerKeepsOneTimer(t *testing.T) {
+	clock := memorytest.NewClock(time.Date(2024, 5, 6, 8, 0, 0, 0, time.UTC))
+
+	model := memorytest.NewModel(
+		memorytest.Text("Standup starts now.").
+			Expect(lastContains(llms.ChatMessageTypeSystem, "Standup")),
+	)
+
+	h := newHarness(t, dbPath(t), model, nil, memory.WithClock(clock))
+
+	if err := h.processor.Scheduler.Schedule("0 9 * * *", "Daily review"); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+
+	h.start()
+
+	// every task wakes the processor loop, e.g. the inspector's refresh
+	for i := 0; i < 100; i++ {
+		h.processor.Do(func(ctx context.Context) {})
+	}
+
+	// an earlier reminder moves the timer
+	_, err := h.processor.Scheduler.Remind(clock.Now().Add(10*time.Minute), "Standup")
+	if err != nil {
+		t.Fatalf("reminding: %v", err)
+	}
+
+	clock.Advance(10 * time.Minute)
+
+	if notification := h.waitNotification(); notification != "Standup starts now." {
+		t.Errorf("notification = %q, want %q", notification, "Standup starts now.")
+	}
+
+	h.stop()
+	h.checkModel()
+
+	if timers := clock.Timers(); timers != 1 {
+		t.Errorf("created %d timers, want 1", timers)
+	}
+}
@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MessageStats describes the messages moved to long term memory.
+type MessageStats struct {
+	Archived int
+
+	// creation dates of the oldest and newest archived messages
+	Oldest time.Time
+	Newest time.Time
+
+	// time messages were last evicted from the FIFO queue
+	LastEviction time.Time
+}
+
+// PassageStats describes the passages stored in archival memory.
+type PassageStats struct {
+	Passages int
+	Oldest   time.Time
+	Newest   time.Time
+}
+
+// SectionUsage is the token usage of a memory section against its budget.
+type SectionUsage struct {
+	Tokens int
+	Budget int
+}
+
+func (usage SectionUsage) String() string {
+	if usage.Budget == 0 {
+		return fmt.Sprintf("%d tokens", usage.Tokens)
+	}
+
+	return fmt.Sprintf("%d/%d tokens (%d%%)", usage.Tokens, usage.Budget, usage.Tokens*100/usage.Budget)
+}
+
+// Level is the pressure level the section is at.
+func (usage SectionUsage) Level() PressureLevel {
+	if usage.Budget == 0 {
+		return PressureNone
+	}
+
+	return pressureLevel(usage.Tokens, float32(usage.Budget))
+}
+
+// MemoryStats is shown to the model in the primer, so it knows
+// how much is stored outside its context and what to search.
+type MemoryStats struct {
+	Messages MessageStats
+	Passages PassageStats
+
+	WorkingContext SectionUsage
+	Queue          SectionUsage
+	Summary        SectionUsage
+	Pinned         SectionUsage
+}
+
+// Stats collects the memory stats, the storage counts are left
+// empty when the storage can't be read.
+func (memory *MemoryContext) Stats() MemoryStats {
+	stats := MemoryStats{
+		WorkingContext: SectionUsage{memory.CurrentWorkingContextSize(), int(memory.workingCtxSize)},
+		Queue:          SectionUsage{memory.CurrentMessagesSize(), int(memory.msgsSize)},
+		Summary:        SectionUsage{memory.CurrentSummarySize(), int(memory.summarySize)},
+		Pinned:         SectionUsage{memory.CurrentPinnedSize(), int(memory.msgsSize * maxPinnedSize)},
+	}
+
+	if memory.Storage == nil {
+		return stats
+	}
+
+	msgStats, err := memory.Storage.MessageStats()
+	if err != nil {
+		memory.logger.Error("loading message stats", "error", err)
+	}
+
+	passageStats, err := memory.Storage.PassageStats()
+	if err != nil {
+		memory.logger.Error("loading passage stats", "error", err)
+	}
+
+	stats.Messages = msgStats
+	stats.Passages = passageStats
+
+	return stats
+}
+
+func (stats MemoryStats) String() string {
+	text := strings.Builder{}
+
+	fmt.Fprintf(&text, "%d previous messages in long term memory", stats.Messages.Archived)
+	if stats.Messages.Archived > 0 {
+		fmt.Fprintf(&text, ", from %s to %s", formatStatsDate(stats.Messages.Oldest), formatStatsDate(stats.Messages.Newest))
+	}
+	text.WriteString(".\n")
+
+	fmt.Fprintf(&text, "%d passages in archival memory", stats.Passages.Passages)
+	if stats.Passages.Passages > 0 {
+		fmt.Fprintf(&text, ", from %s to %s", formatStatsDate(stats.Passages.Oldest), formatStatsDate(stats.Passages.Newest))
+	}
+	text.WriteString(".\n")
+
+	if stats.Messages.LastEviction.IsZero() {
+		text.WriteString("Messages were never evicted.\n")
+	} else {
+		fmt.Fprintf(&text, "Messages were last evicted on %s.\n", formatStatsDate(stats.Messages.LastEviction))
+	}
+
+	fmt.Fprintf(&text, "Working context: %s\n", stats.WorkingContext)
+	fmt.Fprintf(&text, "Messages: %s\n", stats.Queue)
+	fmt.Fprintf(&text, "Recursive summary: %s\n", stats.Summary)
+	fmt.Fprintf(&text, "Pinned messages: %s", stats.Pinned)
+
+	return text.String()
+}
+
+func formatStatsDate(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,96 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// number of times a summary that exceeds its budget is shortened
+var maxSummaryRetries = 3
+
+// Summarizer writes the summaries used by memory operations, the
+// recursive summary of evicted messages and summaries that have to
+// fit into a token budget. It can run on a dedicated model, separate
+// from the conversational one.
+type Summarizer struct {
+	llm    llms.Model
+	system *SystemMonitor
+	logger *slog.Logger
+}
+
+func NewSummarizer(llm llms.Model, system *SystemMonitor) *Summarizer {
+	return &Summarizer{
+		llm:    llm,
+		system: system,
+		logger: NopLogger(),
+	}
+}
+
+// Summarize folds the evicted messages into the previous recursive summary,
+// the result is capped to the summary budget.
+func (summarizer *Summarizer) Summarize(ctx context.Context, summary string, evicted []llms.MessageContent) (string, error) {
+	transcript := ""
+	for _, msg := range evicted {
+		transcript += fmt.Sprintf("%s: %s\n", msg.Role, combineAllTextParts(msg.Parts))
+	}
+
+	budget := int(summarizer.system.mainContext.summarySize)
+
+	prompt, err := summarizer.system.RecursiveSummaryPrompt(summary, transcript, budget)
+	if err != nil {
+		return "", err
+	}
+
+	newSummary, err := summarizer.generate(ctx, prompt)
+	if err != nil {
+		summarizer.logger.Error("generating summary", "error", err)
+		return "", err
+	}
+
+	return summarizer.Fit(ctx, newSummary, budget)
+}
+
+// Fit returns the text unchanged when it fits into the token budget,
+// otherwise the text is shortened and retried until it fits.
+func (summarizer *Summarizer) Fit(ctx context.Context, text string, budget int) (string, error) {
+	for retry := 0; summarizer.system.mainContext.countTokens(text) > budget; retry++ {
+		if retry == maxSummaryRetries {
+			return "", fmt.Errorf("summary exceeds %d tokens after %d retries", budget, maxSummaryRetries)
+		}
+
+		prompt, err := summarizer.system.ShortenPrompt(text, budget)
+		if err != nil {
+			return "", err
+		}
+
+		shorter, err := summarizer.generate(ctx, prompt)
+		if err != nil {
+			summarizer.logger.Error("shortening summary", "budget", budget, "error", err)
+			return "", err
+		}
+
+		text = shorter
+	}
+
+	return text, nil
+}
+
+func (summarizer *Summarizer) generate(ctx context.Context, prompt string) (string, error) {
+	response, err := summarizer.llm.GenerateContent(ctx, []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, prompt),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(response.Choices) == 0 || response.Choices[0].Content == "" {
+		return "", errors.New("summarizer returned an empty summary")
+	}
+
+	return response.Choices[0].Content, nil
+}
@@ -1,47 +1,238 @@
 package memory
 
 import (
-	"log"
+	_ "embed"
+	"fmt"
+	"log/slog"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/tmc/langchaingo/llms"
-	"github.com/tmc/langchaingo/prompts"
 )
 
 var (
 
 	// Templates
-	primerAssistantTemplate = `
+	//go:embed template.txt
+	primerAssistantTemplate string
+
+	defaultPersona = "You are a helpful assistant."
+
+	memoryPressureWorkingContextNotice = `
 	{{.time}}
-	
-	You are a helpful assistant. 
 
-	Your current working context is as follows:
-	{{.workingContext}}
+	Memory pressure notice: WorkingContext
+
+	Your working context is filling up, keep new observations short.
+
+	Working context size: {{.workingContextSize}}/{{.budgetSize}} tokens
 	`
 
-	memoryPressureWorkingContext = `
+	memoryPressureWorkingContextWarning = `
 	{{.time}}
-	
+
 	Memory pressure warning: WorkingContext
 
-	Rewrite your working context so it takes up less space.
+	Rewrite your working context so it takes up less space using the Reflect function.
 
-	Working context size: {{.workingContextSize}}
+	Working context size: {{.workingContextSize}}/{{.budgetSize}} tokens
 	`
 
-	memoryPressureMessages = `
+	memoryPressureWorkingContextCritical = `
 	{{.time}}
-	
+
+	Memory pressure critical: WorkingContext
+
+	Your working context is almost full, rewrite it now using the Reflect function and drop facts that are no longer relevant,
+	otherwise the system will shorten it for you.
+
+	Working context size: {{.workingContextSize}}/{{.budgetSize}} tokens
+	`
+
+	memoryPressureWorkingContextFull = `
+	{{.time}}
+
+	Memory pressure: WorkingContext was full
+
+	Your working context exceeded its budget and was shortened by the system, check it for missing facts.
+
+	Working context size: {{.workingContextSize}}/{{.budgetSize}} tokens
+	`
+
+	memoryPressureMessagesNotice = `
+	{{.time}}
+
+	Memory pressure notice: Messages
+
+	Your short term memory is filling up, consider pinning vital messages and moving the rest to long term memory soon.
+
+	Messages size: {{.messagesSize}}/{{.budgetSize}} tokens
+	`
+
+	memoryPressureMessagesWarning = `
+	{{.time}}
+
 	Memory pressure warning: Messages
 
-	Move messages from your short term memory context to your long term memory context and save a sumary of your messages to your short term memory working context.
-	
-	Messages size: {{.messagesSize}}
+	Move messages from your short term memory context to your long term memory context using the Memorize function,
+	the evicted messages will be summarized into your recursive summary.
+
+	Messages size: {{.messagesSize}}/{{.budgetSize}} tokens
+	`
+
+	memoryPressureMessagesCritical = `
+	{{.time}}
+
+	Memory pressure critical: Messages
+
+	Your short term memory is almost full, call the Memorize function now, otherwise the system will flush
+	your messages to long term memory for you.
+
+	Messages size: {{.messagesSize}}/{{.budgetSize}} tokens
+	`
+
+	memoryPressureMessagesFull = `
+	{{.time}}
+
+	Memory pressure: Messages were full
+
+	Your short term memory exceeded its budget, the system moved messages to your long term memory
+	and folded them into your recursive summary. Use the Recall function if you need them.
+
+	Messages size: {{.messagesSize}}/{{.budgetSize}} tokens
+	`
+
+	heartbeatRequested = `
+	{{.time}}
+
+	Heartbeat: function {{.function}} requested a heartbeat, continue your function chain.
+	`
+
+	heartbeatError = `
+	{{.time}}
+
+	Heartbeat: function {{.function}} failed, read the function response and try again or let the user know.
+	`
+
+	budgetExceeded = `
+	{{.time}}
+
+	Usage limit: the {{.scope}} limit of {{.max}} was reached ({{.used}}).
+	The user's last message was not answered and the user was told about the limit.
+	Once you run again, politely apologize and let the user know the limit resets at {{.resets}}.
+	`
+
+	scheduledEvent = `
+	{{.time}}
+
+	Scheduled event: {{.note}}
+	`
+
+	scheduledReminder = `
+	{{.time}}
+
+	Reminder you scheduled for {{.at}}: {{.note}}
+	`
+
+	eventUserLogin = `
+	{{.time}}
+
+	Event: user logged in{{with index . "lastLogin"}}, last login {{.}}{{end}}.
+	`
+
+	eventWebhook = `
+	{{.time}}
+
+	Event: webhook received{{with index . "source"}} from {{.}}{{end}}.
+	Payload: {{.payload}}
+	`
+
+	eventFileChanged = `
+	{{.time}}
+
+	Event: file {{.path}} {{with index . "change"}}{{.}}{{else}}changed{{end}}.
+	`
+
+	eventDefault = `
+	{{.time}}
+
+	Event: {{.type}}
+	Payload: {{.payload}}
+	`
+
+	summaryShorten = `
+	The text below has {{.textSize}} tokens but has to fit into {{.budgetSize}} tokens.
+	Shorten it to fit, keep facts about the user, decisions and open tasks and drop the least
+	important details first. Reply only with the shortened text.
+
+	Text:
+	{{.text}}
+	`
+
+	consolidateWorkingContext = `
+	You are tidying up the working context of an AI assistant while the conversation is idle.
+	The working context stores key details about the user and the assistant's observations.
+
+	Reorganize the working context into clear sections, merge duplicated facts and remove
+	facts that contradict newer ones. Do not drop information that is still relevant and
+	do not exceed {{.workingContextSize}} tokens. Reply only with the new working context.
+
+	Working context:
+	{{.workingContext}}
+	`
+
+	consolidateArchive = `
+	You are consolidating the long term memory of an AI assistant while the conversation is idle.
+	Summarize the archived messages below into a single passage the assistant can search later,
+	keep facts about the user, decisions, dates and open tasks. Reply only with the passage.
+
+	Archived messages:
+	{{.messages}}
+	`
+
+	summaryMessage = `
+	Recursive summary of the messages moved to your long term memory:
+	{{.summary}}
+	`
+
+	summaryRecursive = `
+	You maintain a recursive summary of a conversation between an AI assistant and a user.
+	Messages are evicted from the assistant's short term memory and moved to long term memory,
+	the summary is all that remains of them in the assistant's context.
+
+	Rewrite the summary so it covers both the previous summary and the evicted messages,
+	keep facts about the user, decisions and open tasks. Do not exceed {{.summarySize}} tokens.
+	Reply only with the new summary.
+
+	Previous summary:
+	{{.summary}}
+
+	Evicted messages:
+	{{.messages}}
 	`
 )
 
+// HeartbeatKind is the reason the model is woken by a heartbeat
+type HeartbeatKind string
+
+const (
+	HeartbeatRequested HeartbeatKind = "heartbeat:Requested"
+	HeartbeatError     HeartbeatKind = "heartbeat:Error"
+)
+
+// PrimerVars are the variables rendered into the primer
+type PrimerVars struct {
+	Time           time.Time
+	Persona        string
+	WorkingContext string
+	PinnedMessages string
+	Stats          MemoryStats
+}
+
 type SystemMonitor struct {
 	mainContext *MemoryContext
 	// The system instructions are readonly (static) and contain information
@@ -49,102 +240,400 @@ type SystemMonitor struct {
 	// levels, and instructions on how to use the MemGPT functions
 	// (e.g. how to retrieve out-of-context data).
 	Instructions map[string]string
+
+	// Persona or system prompt of the agent, rendered into
+	// the primer alongside the memory instructions
+	Persona string
+
+	// instructions compiled by Compile, events are registered
+	// while the processor renders
+	templates map[string]*template.Template
+	mu        sync.RWMutex
+
+	// highest pressure level reported per section since it was last cleared
+	pressure map[PressureKind]PressureLevel
+
+	// stats rendered into the primer, collected once per model call
+	stats MemoryStats
+
+	logger *slog.Logger
 }
 
-func NewSystemMonitor(mainContext *MemoryContext) *SystemMonitor {
-	promptTemplate, err := os.ReadFile("./memory/template.txt")
-	if err != nil {
-		log.Printf("Error loading promptTemplate template: %v", err)
+type SystemOption func(*SystemMonitor) error
+
+// WithTemplate replaces the template of an instruction, e.g. "primer:assistantTemplate".
+func WithTemplate(instruction string, template string) SystemOption {
+	return func(system *SystemMonitor) error {
+		system.Instructions[instruction] = template
+		return nil
+	}
+}
+
+// WithTemplateFile replaces the template of an instruction with the contents of a file.
+func WithTemplateFile(instruction string, path string) SystemOption {
+	return func(system *SystemMonitor) error {
+		template, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("loading %s template: %w", instruction, err)
+		}
+
+		system.Instructions[instruction] = string(template)
+		return nil
 	}
+}
 
-	return &SystemMonitor{
+func WithPersona(persona string) SystemOption {
+	return func(system *SystemMonitor) error {
+		system.Persona = persona
+		return nil
+	}
+}
+
+// WithPersonaFile loads the persona from a file.
+func WithPersonaFile(path string) SystemOption {
+	return func(system *SystemMonitor) error {
+		persona, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("loading persona: %w", err)
+		}
+
+		system.Persona = string(persona)
+		return nil
+	}
+}
+
+// NewSystemMonitor applies the options and compiles the templates,
+// an invalid template override fails here instead of mid conversation.
+func NewSystemMonitor(mainContext *MemoryContext, opts ...SystemOption) (*SystemMonitor, error) {
+	system := &SystemMonitor{
 		mainContext: mainContext,
+		Persona:     defaultPersona,
+		pressure:    map[PressureKind]PressureLevel{},
+		logger:      NopLogger(),
 		Instructions: map[string]string{
-			"primer:assistantTemplate":      string(promptTemplate),
-			"memoryPressure:WorkingContext": memoryPressureWorkingContext,
-			"memoryPressure:Messages":       memoryPressureMessages,
+			"primer:assistantTemplate":               primerAssistantTemplate,
+			"memoryPressure:WorkingContext:Notice":   memoryPressureWorkingContextNotice,
+			"memoryPressure:WorkingContext:Warning":  memoryPressureWorkingContextWarning,
+			"memoryPressure:WorkingContext:Critical": memoryPressureWorkingContextCritical,
+			"memoryPressure:WorkingContext:Full":     memoryPressureWorkingContextFull,
+			"memoryPressure:Messages:Notice":         memoryPressureMessagesNotice,
+			"memoryPressure:Messages:Warning":        memoryPressureMessagesWarning,
+			"memoryPressure:Messages:Critical":       memoryPressureMessagesCritical,
+			"memoryPressure:Messages:Full":           memoryPressureMessagesFull,
+			"heartbeat:Requested":                    heartbeatRequested,
+			"heartbeat:Error":                        heartbeatError,
+			"budget:Exceeded":                        budgetExceeded,
+			"schedule:Event":                         scheduledEvent,
+			"schedule:Reminder":                      scheduledReminder,
+			"event:" + EventUserLogin:                eventUserLogin,
+			"event:" + EventWebhook:                  eventWebhook,
+			"event:" + EventFileChanged:              eventFileChanged,
+			"event:Default":                          eventDefault,
+			"consolidate:WorkingContext":             consolidateWorkingContext,
+			"consolidate:Archive":                    consolidateArchive,
+			"summary:Message":                        summaryMessage,
+			"summary:Recursive":                      summaryRecursive,
+			"summary:Shorten":                        summaryShorten,
 		},
 	}
-}
 
-func (system *SystemMonitor) Instruction(instruction string, variables map[string]any) (string, error) {
-	template := prompts.PromptTemplate{
-		Template:         system.Instructions[instruction],
-		TemplateFormat:   prompts.TemplateFormatGoTemplate,
-		PartialVariables: variables,
+	for _, opt := range opts {
+		err := opt(system)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	prompt, err := template.Format(variables)
+	err := system.Compile()
 	if err != nil {
-		log.Printf("Error formatting prompt: %v", err)
-		return "", err
+		return nil, err
 	}
 
-	return prompt, nil
+	return system, nil
 }
 
-func (system *SystemMonitor) InspectMemoryPressure() []llms.MessageContent {
-	warrnings := []llms.MessageContent{}
+// Compile parses every instruction and checks the variables it uses,
+// it has to be called again after Instructions is changed.
+func (system *SystemMonitor) Compile() error {
+	system.mu.Lock()
+	defer system.mu.Unlock()
 
-	if system.mainContext.CurrentWorkingContextSize() >= int(system.mainContext.workingCtxSize*0.9) {
-		sysPrompt, err := system.Instruction("memoryPressure:WorkingContext", map[string]any{
-			"workingContextSize": system.mainContext.CurrentWorkingContextSize(),
-		})
+	templates := map[string]*template.Template{}
+	problems := []string{}
 
+	for instruction, text := range system.Instructions {
+		tmpl, err := compileTemplate(instruction, text)
 		if err != nil {
-			log.Printf("Error formatting prompt: %v", err)
-			return warrnings
+			problems = append(problems, err.Error())
+			continue
 		}
 
-		sysMsg := llms.TextParts(llms.ChatMessageTypeSystem, sysPrompt)
+		templates[instruction] = tmpl
+	}
+
+	for instruction := range templateSpecs {
+		if _, ok := system.Instructions[instruction]; !ok {
+			problems = append(problems, fmt.Sprintf("missing %s template", instruction))
+		}
+	}
 
-		warrnings = append(warrnings, sysMsg)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid templates: %s", strings.Join(problems, "; "))
 	}
 
-	if system.mainContext.CurrentMessagesSize() >= int(system.mainContext.msgsSize*0.9) {
-		sysPrompt, err := system.Instruction("memoryPressure:Messages", map[string]any{
-			"messagesSize": system.mainContext.CurrentMessagesSize(),
-		})
+	system.templates = templates
 
-		if err != nil {
-			log.Printf("Error formatting prompt: %v", err)
-			return warrnings
-		}
+	return nil
+}
+
+func (system *SystemMonitor) render(instruction string, variables map[string]any) (string, error) {
+	system.mu.RLock()
+	tmpl, ok := system.templates[instruction]
+	system.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("unknown instruction %q", instruction)
+	}
 
-		sysMsg := llms.TextParts(llms.ChatMessageTypeSystem, sysPrompt)
+	spec, _ := specFor(instruction)
+	err := spec.checkVariables(instruction, variables)
+	if err != nil {
+		return "", err
+	}
 
-		warrnings = append(warrnings, sysMsg)
+	prompt := strings.Builder{}
+	err = tmpl.Execute(&prompt, variables)
+	if err != nil {
+		system.logger.Error("formatting prompt", "instruction", instruction, "error", err)
+		return "", err
 	}
 
-	return warrnings
+	return prompt.String(), nil
 }
 
-func (system *SystemMonitor) AppendMessage(msg llms.MessageContent) error {
-	primerPrompt, err := system.Instruction("primer:assistantTemplate", map[string]any{
-		"time":           time.Now().Format("January 02, 2006, 15:04:05"),
-		"workingContext": system.mainContext.WorkingContext,
+// PrimerPrompt renders the primer, the zero time defaults to now
+func (system *SystemMonitor) PrimerPrompt(vars PrimerVars) (string, error) {
+	if vars.Time.IsZero() {
+		vars.Time = time.Now()
+	}
+
+	return system.render("primer:assistantTemplate", map[string]any{
+		"time":           formatTime(vars.Time),
+		"persona":        vars.Persona,
+		"workingContext": vars.WorkingContext,
+		"pinnedMessages": vars.PinnedMessages,
+		"memoryStats":    vars.Stats.String(),
+	})
+}
+
+// SummaryMessage renders the recursive summary kept in the context head
+func (system *SystemMonitor) SummaryMessage(summary string) (string, error) {
+	return system.render("summary:Message", map[string]any{
+		"summary": summary,
+	})
+}
+
+// RecursiveSummaryPrompt asks to fold the evicted messages into the summary
+func (system *SystemMonitor) RecursiveSummaryPrompt(summary string, messages string, budget int) (string, error) {
+	return system.render("summary:Recursive", map[string]any{
+		"summary":     summary,
+		"messages":    messages,
+		"summarySize": budget,
+	})
+}
+
+// ShortenPrompt asks to shorten the text to fit into the budget
+func (system *SystemMonitor) ShortenPrompt(text string, budget int) (string, error) {
+	return system.render("summary:Shorten", map[string]any{
+		"text":       text,
+		"textSize":   system.mainContext.countTokens(text),
+		"budgetSize": budget,
+	})
+}
+
+// ConsolidateWorkingContextPrompt asks to reorganize the working context
+func (system *SystemMonitor) ConsolidateWorkingContextPrompt(workingContext string, budget int) (string, error) {
+	return system.render("consolidate:WorkingContext", map[string]any{
+		"workingContext":     workingContext,
+		"workingContextSize": budget,
+	})
+}
+
+// ConsolidateArchivePrompt asks to fold archived messages into a passage
+func (system *SystemMonitor) ConsolidateArchivePrompt(messages string) (string, error) {
+	return system.render("consolidate:Archive", map[string]any{
+		"messages": messages,
+	})
+}
+
+// Heartbeat creates the system message explaining why the model was woken
+func (system *SystemMonitor) Heartbeat(heartbeat HeartbeatKind, function string) (llms.MessageContent, error) {
+	sysPrompt, err := system.render(string(heartbeat), map[string]any{
+		"time":     formatTime(time.Now()),
+		"function": function,
+	})
+
+	if err != nil {
+		return llms.MessageContent{}, err
+	}
+
+	return llms.TextParts(llms.ChatMessageTypeSystem, sysPrompt), nil
+}
+
+// BudgetExceeded creates the system message telling the model a usage limit was reached
+func (system *SystemMonitor) BudgetExceeded(budgetErr *BudgetError) (string, error) {
+	return system.render("budget:Exceeded", map[string]any{
+		"time":   formatTime(time.Now()),
+		"scope":  budgetErr.Scope,
+		"limit":  budgetErr.Limit,
+		"used":   budgetErr.Used,
+		"max":    budgetErr.Max,
+		"resets": formatTime(budgetErr.Resets),
+	})
+}
+
+// ScheduledEvent creates the system message for a due job or reminder
+func (system *SystemMonitor) ScheduledEvent(event ScheduledEvent) (llms.MessageContent, error) {
+	instruction := "schedule:Event"
+	if event.Reminder {
+		instruction = "schedule:Reminder"
+	}
+
+	sysPrompt, err := system.render(instruction, map[string]any{
+		"time": formatTime(time.Now()),
+		"at":   formatTime(event.At),
+		"note": event.Note,
 	})
 
 	if err != nil {
-		log.Printf("Error formatting prompt: %v", err)
+		return llms.MessageContent{}, err
+	}
+
+	return llms.TextParts(llms.ChatMessageTypeSystem, sysPrompt), nil
+}
+
+// RegisterEvent defines the template for a new event type, or replaces
+// the template of an existing one. The payload fields are available as
+// template variables, together with time, type and the JSON payload,
+// optional fields should be accessed with index to avoid missing key errors.
+func (system *SystemMonitor) RegisterEvent(eventType string, text string) error {
+	instruction := "event:" + eventType
+
+	tmpl, err := compileTemplate(instruction, text)
+	if err != nil {
 		return err
 	}
 
-	// log.Printf("System primer prompt: %s", primerPrompt)
+	system.mu.Lock()
+	defer system.mu.Unlock()
+
+	system.Instructions[instruction] = text
+	system.templates[instruction] = tmpl
+
+	return nil
+}
+
+// Event formats the event into a message with the event role
+func (system *SystemMonitor) Event(event Event) (llms.MessageContent, error) {
+	instruction := "event:" + event.Type
+
+	system.mu.RLock()
+	if _, ok := system.templates[instruction]; !ok {
+		instruction = "event:Default"
+	}
+	system.mu.RUnlock()
+
+	variables := map[string]any{}
+	for key, value := range event.Payload {
+		variables[key] = value
+	}
+
+	variables["time"] = formatTime(time.Now())
+	variables["type"] = event.Type
+	variables["payload"] = event.payloadJSON()
+
+	sysPrompt, err := system.render(instruction, variables)
+	if err != nil {
+		return llms.MessageContent{}, err
+	}
+
+	return llms.TextParts(ChatMessageTypeEvent, sysPrompt), nil
+}
+
+// pinnedMessages lists previews of the pinned messages for the primer,
+// the full messages are already in the FIFO queue
+func (system *SystemMonitor) pinnedMessages() string {
+	pinned := ""
+	for _, msg := range system.mainContext.PinnedMessages() {
+		preview := combineAllTextParts(msg.Parts)
+		if runes := []rune(preview); len(runes) > 80 {
+			preview = string(runes[:80]) + "..."
+		}
+
+		pinned += fmt.Sprintf("- %s: %s\n", msg.Role, preview)
+	}
+
+	if pinned == "" {
+		return "No pinned messages."
+	}
+
+	return pinned
+}
+
+// RefreshHead collects the memory stats and renders the primer and
+// the summary at the head of the FIFO queue
+func (system *SystemMonitor) RefreshHead() error {
+	system.stats = system.mainContext.Stats()
+
+	return system.renderHead()
+}
+
+// renderHead renders the head with the last collected stats
+func (system *SystemMonitor) renderHead() error {
+	primerPrompt, err := system.PrimerPrompt(PrimerVars{
+		Persona:        system.Persona,
+		WorkingContext: system.mainContext.WorkingContext,
+		PinnedMessages: system.pinnedMessages(),
+		Stats:          system.stats,
+	})
+
+	if err != nil {
+		system.logger.Error("formatting primer", "error", err)
+		return err
+	}
 
-	primerMsg := llms.TextParts(llms.ChatMessageTypeSystem, primerPrompt)
+	head := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, primerPrompt),
+	}
 
-	if len(system.mainContext.Messages) == 0 {
-		system.mainContext.Messages = []llms.MessageContent{primerMsg}
-	} else {
-		if system.mainContext.Messages[0].Role == llms.ChatMessageTypeSystem {
-			system.mainContext.Messages[0] = primerMsg
-		} else {
-			system.mainContext.Messages = append([]llms.MessageContent{primerMsg}, system.mainContext.Messages...)
+	if system.mainContext.Summary != "" {
+		summaryPrompt, err := system.SummaryMessage(system.mainContext.Summary)
+		if err != nil {
+			system.logger.Error("formatting summary", "error", err)
+			return err
 		}
+
+		head = append(head, llms.TextParts(llms.ChatMessageTypeSystem, summaryPrompt))
+	}
+
+	system.mainContext.SetHead(head...)
+
+	return nil
+}
+
+func (system *SystemMonitor) AppendMessage(msg llms.MessageContent) error {
+	// the stats are collected again before the next model call
+	err := system.renderHead()
+	if err != nil {
+		return err
 	}
 
 	system.mainContext.Messages = append(system.mainContext.Messages, msg)
 
 	return nil
 }
+
+func formatTime(t time.Time) string {
+	return t.Format("January 02, 2006, 15:04:05")
+}
@@ -0,0 +1,249 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// templateSpec declares the variables an instruction is rendered with,
+// required variables have to be used by the template, optional ones may be.
+// Dynamic templates (events) are rendered with arbitrary payload variables.
+type templateSpec struct {
+	required []string
+	optional []string
+	dynamic  bool
+}
+
+var templateSpecs = map[string]templateSpec{
+	"primer:assistantTemplate": {
+		required: []string{"workingContext"},
+		optional: []string{"time", "persona", "pinnedMessages", "memoryStats"},
+	},
+	"memoryPressure:WorkingContext:Notice": {
+		required: []string{"workingContextSize"},
+		optional: []string{"time", "budgetSize"},
+	},
+	"memoryPressure:WorkingContext:Warning": {
+		required: []string{"workingContextSize"},
+		optional: []string{"time", "budgetSize"},
+	},
+	"memoryPressure:WorkingContext:Critical": {
+		required: []string{"workingContextSize"},
+		optional: []string{"time", "budgetSize"},
+	},
+	"memoryPressure:WorkingContext:Full": {
+		required: []string{"workingContextSize"},
+		optional: []string{"time", "budgetSize"},
+	},
+	"memoryPressure:Messages:Notice": {
+		required: []string{"messagesSize"},
+		optional: []string{"time", "budgetSize"},
+	},
+	"memoryPressure:Messages:Warning": {
+		required: []string{"messagesSize"},
+		optional: []string{"time", "budgetSize"},
+	},
+	"memoryPressure:Messages:Critical": {
+		required: []string{"messagesSize"},
+		optional: []string{"time", "budgetSize"},
+	},
+	"memoryPressure:Messages:Full": {
+		required: []string{"messagesSize"},
+		optional: []string{"time", "budgetSize"},
+	},
+	"heartbeat:Requested": {
+		optional: []string{"time", "function"},
+	},
+	"heartbeat:Error": {
+		optional: []string{"time", "function"},
+	},
+	"budget:Exceeded": {
+		required: []string{"scope", "max"},
+		optional: []string{"time", "limit", "used", "resets"},
+	},
+	"schedule:Event": {
+		required: []string{"note"},
+		optional: []string{"time", "at"},
+	},
+	"schedule:Reminder": {
+		required: []string{"note"},
+		optional: []string{"time", "at"},
+	},
+	"consolidate:WorkingContext": {
+		required: []string{"workingContext"},
+		optional: []string{"workingContextSize"},
+	},
+	"consolidate:Archive": {
+		required: []string{"messages"},
+	},
+	"summary:Message": {
+		required: []string{"summary"},
+	},
+	"summary:Recursive": {
+		required: []string{"summary", "messages"},
+		optional: []string{"summarySize"},
+	},
+	"summary:Shorten": {
+		required: []string{"text"},
+		optional: []string{"textSize", "budgetSize"},
+	},
+}
+
+func specFor(instruction string) (templateSpec, bool) {
+	if strings.HasPrefix(instruction, "event:") {
+		return templateSpec{dynamic: true}, true
+	}
+
+	spec, ok := templateSpecs[instruction]
+	return spec, ok
+}
+
+// compileTemplate parses the template and checks the variables it uses
+// against the spec of the instruction.
+func compileTemplate(instruction string, text string) (*template.Template, error) {
+	spec, ok := specFor(instruction)
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction %q", instruction)
+	}
+
+	tmpl, err := template.New(instruction).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s template: %w", instruction, err)
+	}
+
+	if spec.dynamic {
+		return tmpl, nil
+	}
+
+	used := map[string]struct{}{}
+	templateVariables(tmpl.Tree.Root, true, used)
+
+	missing := []string{}
+	for _, variable := range spec.required {
+		if _, ok := used[variable]; !ok {
+			missing = append(missing, variable)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s template is missing required variables: %s", instruction, strings.Join(missing, ", "))
+	}
+
+	known := spec.variables()
+	extra := []string{}
+	for variable := range used {
+		if _, ok := known[variable]; !ok {
+			extra = append(extra, variable)
+		}
+	}
+
+	if len(extra) > 0 {
+		sort.Strings(extra)
+		return nil, fmt.Errorf("%s template uses unknown variables: %s", instruction, strings.Join(extra, ", "))
+	}
+
+	return tmpl, nil
+}
+
+func (spec templateSpec) variables() map[string]struct{} {
+	variables := map[string]struct{}{}
+	for _, variable := range append(spec.required, spec.optional...) {
+		variables[variable] = struct{}{}
+	}
+
+	return variables
+}
+
+// checkVariables verifies the supplied variables match the spec.
+func (spec templateSpec) checkVariables(instruction string, variables map[string]any) error {
+	if spec.dynamic {
+		return nil
+	}
+
+	known := spec.variables()
+
+	for variable := range known {
+		if _, ok := variables[variable]; !ok {
+			return fmt.Errorf("%s template rendered without variable %s", instruction, variable)
+		}
+	}
+
+	for variable := range variables {
+		if _, ok := known[variable]; !ok {
+			return fmt.Errorf("%s template rendered with unknown variable %s", instruction, variable)
+		}
+	}
+
+	return nil
+}
+
+// templateVariables collects the top level variables used by the template,
+// root is false inside with and range blocks where the dot is rebound.
+func templateVariables(node parse.Node, root bool, variables map[string]struct{}) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+
+		for _, child := range n.Nodes {
+			templateVariables(child, root, variables)
+		}
+	case *parse.ActionNode:
+		pipeVariables(n.Pipe, root, variables)
+	case *parse.IfNode:
+		pipeVariables(n.Pipe, root, variables)
+		templateVariables(n.List, root, variables)
+		templateVariables(n.ElseList, root, variables)
+	case *parse.WithNode:
+		pipeVariables(n.Pipe, root, variables)
+		templateVariables(n.List, false, variables)
+		templateVariables(n.ElseList, root, variables)
+	case *parse.RangeNode:
+		pipeVariables(n.Pipe, root, variables)
+		templateVariables(n.List, false, variables)
+		templateVariables(n.ElseList, root, variables)
+	case *parse.TemplateNode:
+		pipeVariables(n.Pipe, root, variables)
+	}
+}
+
+func pipeVariables(pipe *parse.PipeNode, root bool, variables map[string]struct{}) {
+	if pipe == nil {
+		return
+	}
+
+	for _, cmd := range pipe.Cmds {
+		// optional variables accessed with index . "name"
+		if len(cmd.Args) == 3 {
+			if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok && ident.Ident == "index" {
+				_, dot := cmd.Args[1].(*parse.DotNode)
+				if name, ok := cmd.Args[2].(*parse.StringNode); ok && dot && root {
+					variables[name.Text] = struct{}{}
+				}
+			}
+		}
+
+		for _, arg := range cmd.Args {
+			switch a := arg.(type) {
+			case *parse.FieldNode:
+				if root {
+					variables[a.Ident[0]] = struct{}{}
+				}
+			case *parse.VariableNode:
+				if a.Ident[0] == "$" && len(a.Ident) > 1 {
+					variables[a.Ident[1]] = struct{}{}
+				}
+			case *parse.PipeNode:
+				pipeVariables(a, root, variables)
+			case *parse.ChainNode:
+				if field, ok := a.Node.(*parse.FieldNode); ok && root {
+					variables[field.Ident[0]] = struct{}{}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/Struki84/GoMemGPT/memory"
+
+// endSpan records the error on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// tracedStorage records a span for every storage operation. The storage
+// methods take no context, the spans are children of the processor's
+// innermost span instead, set with withParent.
+type tracedStorage struct {
+	MemoryStorage
+	tracer  trace.Tracer
+	metrics *metrics
+
+	mu     sync.Mutex
+	parent context.Context
+}
+
+func newTracedStorage(storage MemoryStorage, tracer trace.Tracer) *tracedStorage {
+	// wrapping twice would record every operation twice
+	if traced, ok := storage.(*tracedStorage); ok {
+		storage = traced.MemoryStorage
+	}
+
+	return &tracedStorage{
+		MemoryStorage: storage,
+		tracer:        tracer,
+		parent:        context.Background(),
+	}
+}
+
+// withParent links the following operations to the span of ctx
+// and returns a function restoring the previous parent
+func (storage *tracedStorage) withParent(ctx context.Context) func() {
+	if storage == nil {
+		return func() {}
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	previous := storage.parent
+	storage.parent = ctx
+
+	return func() {
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+
+		storage.parent = previous
+	}
+}
+
+func (storage *tracedStorage) start(operation string, attrs ...attribute.KeyValue) trace.Span {
+	storage.mu.Lock()
+	parent := storage.parent
+	storage.mu.Unlock()
+
+	attrs = append(attrs, attribute.String("db.operation.name", operation))
+	_, span := storage.tracer.Start(parent, "storage "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+
+	return span
+}
+
+// end ends the span of the operation and counts its error
+func (storage *tracedStorage) end(span trace.Span, operation string, err error) {
+	// an already saved queue is not a failure
+	if errors.Is(err, ErrNoNewMessages) {
+		err = nil
+	}
+
+	storage.metrics.storageFailed(operation, err)
+	endSpan(span, err)
+}
+
+func (storage *tracedStorage) LoadMessages() ([]llms.MessageContent, error) {
+	span := storage.start("LoadMessages")
+	msgs, err := storage.MemoryStorage.LoadMessages()
+	span.SetAttributes(attribute.Int("messages", len(msgs)))
+	storage.end(span, "LoadMessages", err)
+
+	return msgs, err
+}
+
+func (storage *tracedStorage) SaveMessages(messages []llms.MessageContent) error {
+	span := storage.start("SaveMessages", attribute.Int("messages", len(messages)))
+	err := storage.MemoryStorage.SaveMessages(messages)
+	storage.end(span, "SaveMessages", err)
+
+	return err
+}
+
+func (storage *tracedStorage) LoadWorkingContext() (string, error) {
+	span := storage.start("LoadWorkingContext")
+	workingContext, err := storage.MemoryStorage.LoadWorkingContext()
+	storage.end(span, "LoadWorkingContext", err)
+
+	return workingContext, err
+}
+
+func (storage *tracedStorage) SaveWorkingContext(workingContext string) error {
+	span := storage.start("SaveWorkingContext")
+	err := storage.MemoryStorage.SaveWorkingContext(workingContext)
+	storage.end(span, "SaveWorkingContext", err)
+
+	return err
+}
+
+func (storage *tracedStorage) LoadSummary() (string, error) {
+	span := storage.start("LoadSummary")
+	summary, err := storage.MemoryStorage.LoadSummary()
+	storage.end(span, "LoadSummary", err)
+
+	return summary, err
+}
+
+func (storage *tracedStorage) SaveSummary(summary string) error {
+	span := storage.start("SaveSummary")
+	err := storage.MemoryStorage.SaveSummary(summary)
+	storage.end(span, "SaveSummary", err)
+
+	return err
+}
+
+func (storage *tracedStorage) RecallMessages(query RecallQuery) (RecallResult, error) {
+	span := storage.start("RecallMessages", attribute.Int("limit", query.Limit), attribute.Int("offset", query.Offset))
+	result, err := storage.MemoryStorage.RecallMessages(query)
+	span.SetAttributes(attribute.Int("messages", len(result.Messages)), attribute.Int("total", result.Total))
+	storage.end(span, "RecallMessages", err)
+
+	return result, err
+}
+
+func (storage *tracedStorage) ArchiveMessages(messages []llms.MessageContent) error {
+	span := storage.start("ArchiveMessages", attribute.Int("messages", len(messages)))
+	err := storage.MemoryStorage.ArchiveMessages(messages)
+	storage.end(span, "ArchiveMessages", err)
+
+	return err
+}
+
+func (storage *tracedStorage) LoadUnconsolidatedMessages(limit int) ([]RecalledMessage, error) {
+	span := storage.start("LoadUnconsolidatedMessages", attribute.Int("limit", limit))
+	msgs, err := storage.MemoryStorage.LoadUnconsolidatedMessages(limit)
+	span.SetAttributes(attribute.Int("messages", len(msgs)))
+	storage.end(span, "LoadUnconsolidatedMessages", err)
+
+	return msgs, err
+}
+
+func (storage *tracedStorage) ConsolidateMessages(ids []uint) error {
+	span := storage.start("ConsolidateMessages", attribute.Int("messages", len(ids)))
+	err := storage.MemoryStorage.ConsolidateMessages(ids)
+	storage.end(span, "ConsolidateMessages", err)
+
+	return err
+}
+
+func (storage *tracedStorage) MessageStats() (MessageStats, error) {
+	span := storage.start("MessageStats")
+	stats, err := storage.MemoryStorage.MessageStats()
+	storage.end(span, "MessageStats", err)
+
+	return stats, err
+}
+
+func (storage *tracedStorage) PassageStats() (PassageStats, error) {
+	span := storage.start("PassageStats")
+	stats, err := storage.MemoryStorage.PassageStats()
+	storage.end(span, "PassageStats", err)
+
+	return stats, err
+}
+
+func (storage *tracedStorage) SaveUsage(usage Usage) error {
+	span := storage.start("SaveUsage", attribute.String("purpose", string(usage.Purpose)))
+	err := storage.MemoryStorage.SaveUsage(usage)
+	storage.end(span, "SaveUsage", err)
+
+	return err
+}
+
+func (storage *tracedStorage) LoadUsage(query UsageQuery) ([]UsageTotal, error) {
+	span := storage.start("LoadUsage", attribute.Bool("all_sessions", query.AllSessions))
+	totals, err := storage.MemoryStorage.LoadUsage(query)
+	storage.end(span, "LoadUsage", err)
+
+	return totals, err
+}
+
+func (storage *tracedStorage) LoadPinnedMessages() ([]llms.MessageContent, error) {
+	span := storage.start("LoadPinnedMessages")
+	msgs, err := storage.MemoryStorage.LoadPinnedMessages()
+	span.SetAttributes(attribute.Int("messages", len(msgs)))
+	storage.end(span, "LoadPinnedMessages", err)
+
+	return msgs, err
+}
+
+func (storage *tracedStorage) PinMessage(message llms.MessageContent, pinned bool) error {
+	span := storage.start("PinMessage", attribute.Bool("pinned", pinned))
+	err := storage.MemoryStorage.PinMessage(message, pinned)
+	storage.end(span, "PinMessage", err)
+
+	return err
+}
+
+func (storage *tracedStorage) TagMessage(message llms.MessageContent, tags []string) error {
+	span := storage.start("TagMessage", attribute.Int("tags", len(tags)))
+	err := storage.MemoryStorage.TagMessage(message, tags)
+	storage.end(span, "TagMessage", err)
+
+	return err
+}
+
+func (storage *tracedStorage) InsertPassages(passages []Passage) error {
+	span := storage.start("InsertPassages", attribute.Int("passages", len(passages)))
+	err := storage.MemoryStorage.InsertPassages(passages)
+	storage.end(span, "InsertPassages", err)
+
+	return err
+}
+
+func (storage *tracedStorage) SearchPassages(query PassageQuery) ([]Passage, int, error) {
+	span := storage.start("SearchPassages",
+		attribute.Int("limit", query.Limit),
+		attribute.Int("offset", query.Offset),
+		attribute.Bool("embedding", len(query.Embedding) > 0),
+	)
+
+	passages, total, err := storage.MemoryStorage.SearchPassages(query)
+	span.SetAttributes(attribute.Int("passages", len(passages)), attribute.Int("total", total))
+	storage.end(span, "SearchPassages", err)
+
+	return passages, total, err
+}
+
+func (storage *tracedStorage) LoadReminders() ([]Reminder, error) {
+	span := storage.start("LoadReminders")
+	reminders, err := storage.MemoryStorage.LoadReminders()
+	span.SetAttributes(attribute.Int("reminders", len(reminders)))
+	storage.end(span, "LoadReminders", err)
+
+	return reminders, err
+}
+
+func (storage *tracedStorage) SaveReminder(reminder Reminder) (Reminder, error) {
+	span := storage.start("SaveReminder")
+	saved, err := storage.MemoryStorage.SaveReminder(reminder)
+	storage.end(span, "SaveReminder", err)
+
+	return saved, err
+}
+
+func (storage *tracedStorage) CompleteReminder(id uint) error {
+	span := storage.start("CompleteReminder")
+	err := storage.MemoryStorage.CompleteReminder(id)
+	storage.end(span, "CompleteReminder", err)
+
+	return err
+}
@@ -0,0 +1,362 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// UsagePurpose tells what a model call was made for.
+type UsagePurpose string
+
+const (
+	UsageChat          UsagePurpose = "chat"
+	UsageSummarization UsagePurpose = "summarization"
+	UsageConsolidation UsagePurpose = "consolidation"
+	UsageEmbedding     UsagePurpose = "embedding"
+)
+
+// Usage is the token usage of a single model call.
+type Usage struct {
+	// Session the call was made in, set by the storage
+	Session string
+
+	// Turn the call was made in, 0 outside of a turn (e.g. consolidation)
+	Turn    int
+	Purpose UsagePurpose
+	Model   string
+
+	PromptTokens     int
+	CompletionTokens int
+
+	// counted locally since the provider didn't report its usage
+	Estimated bool
+
+	CreatedAt time.Time
+}
+
+// UsageQuery filters the recorded usage, zero values are ignored.
+type UsageQuery struct {
+	// Session to total, defaults to the current session
+	Session string
+
+	// Total the usage of all sessions
+	AllSessions bool
+
+	// Usage recorded since
+	Since time.Time
+
+	Purpose UsagePurpose
+	Model   string
+}
+
+// UsageTotal sums up the usage of a model for a purpose in a session.
+type UsageTotal struct {
+	Session string
+	Purpose UsagePurpose
+	Model   string
+
+	Calls            int
+	PromptTokens     int
+	CompletionTokens int
+
+	// calls with locally counted tokens
+	Estimated int
+
+	// Cost estimate in dollars, zero when the model has no price
+	Cost float64
+}
+
+func (total UsageTotal) Tokens() int {
+	return total.PromptTokens + total.CompletionTokens
+}
+
+// ModelPrice is the price of a model in dollars per million tokens.
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+func (price ModelPrice) Cost(promptTokens int, completionTokens int) float64 {
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1_000_000
+}
+
+// Pricing maps model names to their prices, dated model versions
+// (e.g. gpt-4o-2024-08-06) match the longest priced prefix.
+type Pricing map[string]ModelPrice
+
+// DefaultPricing lists the list prices of common models, they are
+// estimates, check the provider's current pricing before billing.
+var DefaultPricing = Pricing{
+	"gpt-4o":                 {Prompt: 2.50, Completion: 10.00},
+	"gpt-4o-mini":            {Prompt: 0.15, Completion: 0.60},
+	"gpt-4.1":                {Prompt: 2.00, Completion: 8.00},
+	"gpt-4.1-mini":           {Prompt: 0.40, Completion: 1.60},
+	"o3-mini":                {Prompt: 1.10, Completion: 4.40},
+	"claude-3-5-sonnet":      {Prompt: 3.00, Completion: 15.00},
+	"claude-3-5-haiku":       {Prompt: 0.80, Completion: 4.00},
+	"claude-3-opus":          {Prompt: 15.00, Completion: 75.00},
+	"text-embedding-3-small": {Prompt: 0.02},
+	"text-embedding-3-large": {Prompt: 0.13},
+	"text-embedding-ada-002": {Prompt: 0.10},
+}
+
+// Price returns the price of the model.
+func (pricing Pricing) Price(model string) (ModelPrice, bool) {
+	if price, ok := pricing[model]; ok {
+		return price, true
+	}
+
+	match := ""
+	for name := range pricing {
+		if strings.HasPrefix(model, name) && len(name) > len(match) {
+			match = name
+		}
+	}
+
+	if match == "" {
+		return ModelPrice{}, false
+	}
+
+	return pricing[match], true
+}
+
+// UsageReport holds the usage totals and their cost estimates.
+type UsageReport struct {
+	Totals []UsageTotal
+	Cost   float64
+
+	// models without a price, their cost is not included
+	Unpriced []string
+}
+
+func (report UsageReport) Tokens() (promptTokens int, completionTokens int) {
+	for _, total := range report.Totals {
+		promptTokens += total.PromptTokens
+		completionTokens += total.CompletionTokens
+	}
+
+	return promptTokens, completionTokens
+}
+
+// LoadUsageReport totals the usage recorded in the storage and estimates its cost.
+func LoadUsageReport(storage MemoryStorage, query UsageQuery, pricing Pricing) (UsageReport, error) {
+	totals, err := storage.LoadUsage(query)
+	if err != nil {
+		return UsageReport{}, err
+	}
+
+	report := UsageReport{Totals: totals}
+	unpriced := map[string]struct{}{}
+
+	for i, total := range report.Totals {
+		price, ok := pricing.Price(total.Model)
+		if !ok {
+			unpriced[total.Model] = struct{}{}
+			continue
+		}
+
+		report.Totals[i].Cost = price.Cost(total.PromptTokens, total.CompletionTokens)
+		report.Cost += report.Totals[i].Cost
+	}
+
+	for model := range unpriced {
+		if model == "" {
+			model = "unnamed model"
+		}
+
+		report.Unpriced = append(report.Unpriced, model)
+	}
+
+	sort.Strings(report.Unpriced)
+
+	return report, nil
+}
+
+// TokenUsage reads the token counts the providers report in the generation
+// info, openai and ollama report PromptTokens, anthropic InputTokens.
+func TokenUsage(info map[string]any) (promptTokens int, completionTokens int) {
+	return usageValue(info, "PromptTokens", "InputTokens"), usageValue(info, "CompletionTokens", "OutputTokens")
+}
+
+func usageValue(info map[string]any, keys ...string) int {
+	for _, key := range keys {
+		switch value := info[key].(type) {
+		case int:
+			return value
+		case int32:
+			return int(value)
+		case int64:
+			return int(value)
+		case float64:
+			return int(value)
+		}
+	}
+
+	return 0
+}
+
+// measureUsage returns the usage reported by the provider, the tokens
+// are counted locally when the response doesn't include it
+func (memory *MemoryContext) measureUsage(messages []llms.MessageContent, response *llms.ContentResponse) (usage Usage) {
+	for _, choice := range response.Choices {
+		promptTokens, completionTokens := TokenUsage(choice.GenerationInfo)
+
+		// the prompt is the same for every choice
+		usage.PromptTokens = max(usage.PromptTokens, promptTokens)
+		usage.CompletionTokens += completionTokens
+	}
+
+	if usage.PromptTokens > 0 || usage.CompletionTokens > 0 {
+		return usage
+	}
+
+	usage.Estimated = true
+
+	for _, msg := range messages {
+		usage.PromptTokens += memory.countTokens(fmt.Sprintf("%s: %s", msg.Role, combineAllTextParts(msg.Parts)))
+	}
+
+	for _, choice := range response.Choices {
+		usage.CompletionTokens += memory.countTokens(choice.Content)
+		for _, toolCall := range choice.ToolCalls {
+			usage.CompletionTokens += memory.countTokens(toolCall.FunctionCall.Name + " " + toolCall.FunctionCall.Arguments)
+		}
+	}
+
+	return usage
+}
+
+// namedModel reports the name of a model for usage and traces
+type namedModel struct {
+	llms.Model
+	name string
+}
+
+// NamedModel names the model in the recorded usage and traces,
+// the model interface doesn't expose its name.
+func NamedModel(llm llms.Model, name string) llms.Model {
+	return namedModel{Model: llm, name: name}
+}
+
+// NamedEmbedder names the embedding model in the recorded usage,
+// a nil embedder stays nil.
+func NamedEmbedder(embedder embeddings.Embedder, name string) embeddings.Embedder {
+	if embedder == nil {
+		return nil
+	}
+
+	return namedEmbedder{Embedder: embedder, name: name}
+}
+
+type namedEmbedder struct {
+	embeddings.Embedder
+	name string
+}
+
+// modelName returns the name given with NamedModel or NamedEmbedder
+func modelName(model any) string {
+	switch named := model.(type) {
+	case namedModel:
+		return named.name
+	case namedEmbedder:
+		return named.name
+	}
+
+	return ""
+}
+
+// meteredModel records the usage of every call of a memory operation
+type meteredModel struct {
+	llms.Model
+	purpose UsagePurpose
+	name    string
+	context *MemoryContext
+	record  func(Usage)
+}
+
+func (model meteredModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	response, err := model.Model.GenerateContent(ctx, messages, options...)
+	if err != nil {
+		return response, err
+	}
+
+	usage := model.context.measureUsage(messages, response)
+	usage.Purpose = model.purpose
+	usage.Model = model.name
+	model.record(usage)
+
+	return response, nil
+}
+
+func (model meteredModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, model, prompt, options...)
+}
+
+// MeteredEmbedder records the tokens embedded outside of a processor,
+// e.g. by an Ingestor, in the storage of the session. A nil embedder stays nil.
+func MeteredEmbedder(embedder embeddings.Embedder, storage MemoryStorage, logger *slog.Logger) embeddings.Embedder {
+	if embedder == nil {
+		return nil
+	}
+
+	if metered, ok := embedder.(meteredEmbedder); ok {
+		embedder = metered.Embedder
+	}
+
+	return meteredEmbedder{
+		Embedder: embedder,
+		name:     modelName(embedder),
+		context:  NewMemoryContext(storage),
+		record: func(usage Usage) {
+			usage.CreatedAt = time.Now()
+
+			err := storage.SaveUsage(usage)
+			if err != nil {
+				logger.Error("saving usage", "purpose", usage.Purpose, "error", err)
+			}
+		},
+	}
+}
+
+// meteredEmbedder records the tokens embedded, embedders don't
+// report their usage so the tokens are always counted locally
+type meteredEmbedder struct {
+	embeddings.Embedder
+	name    string
+	context *MemoryContext
+	record  func(Usage)
+}
+
+func (embedder meteredEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, err := embedder.Embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return vectors, err
+	}
+
+	tokens := 0
+	for _, text := range texts {
+		tokens += embedder.context.countTokens(text)
+	}
+
+	embedder.record(Usage{Purpose: UsageEmbedding, Model: embedder.name, PromptTokens: tokens, Estimated: true})
+
+	return vectors, nil
+}
+
+func (embedder meteredEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	vector, err := embedder.Embedder.EmbedQuery(ctx, text)
+	if err != nil {
+		return vector, err
+	}
+
+	embedder.record(Usage{Purpose: UsageEmbedding, Model: embedder.name, PromptTokens: embedder.context.countTokens(text), Estimated: true})
+
+	return vector, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// setupMetrics serves the prometheus metrics on /metrics when
+// GOMEMGPT_METRICS_ADDR (e.g. :9090) is set, and returns the
+// processor option registering the agent's collectors
+func setupMetrics(logger *slog.Logger) []memory.ProcessorOption {
+	addr := os.Getenv("GOMEMGPT_METRICS_ADDR")
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("serving metrics", "addr", addr, "error", err)
+		}
+	}()
+
+	return []memory.ProcessorOption{memory.WithMetrics(prometheus.DefaultRegisterer)}
+}
@@ -1,6 +1,10 @@
 package storage
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type MsgStatus int
 
@@ -11,9 +15,14 @@ const (
 
 type Memory struct {
 	gorm.Model
-	SessionID string    `json:"sessionId"`
-	Context   string    `json:"workingContext"`
-	Messages  []Message `json:"messages" gorm:"foreignKey:MemoryID"`
+	SessionID string     `json:"sessionId"`
+	Context   string     `json:"workingContext"`
+	Summary   string     `json:"summary"`
+	EvictedAt time.Time  `json:"evictedAt"`
+	Messages  []Message  `json:"messages" gorm:"foreignKey:MemoryID"`
+	Passages  []Passage  `json:"passages" gorm:"foreignKey:MemoryID"`
+	Reminders []Reminder `json:"reminders" gorm:"foreignKey:MemoryID"`
+	Usage     []Usage    `json:"usage" gorm:"foreignKey:MemoryID"`
 }
 
 type Message struct {
@@ -22,4 +31,39 @@ type Message struct {
 	Role     string    `json:"type"`
 	Content  string    `json:"text"`
 	Status   MsgStatus `json:"status"`
+	Pinned   bool      `json:"pinned"`
+	Tags     string    `json:"tags"`
+
+	// archived messages summarized into archival passages
+	Consolidated bool `json:"consolidated"`
+}
+
+type Passage struct {
+	gorm.Model
+	MemoryID  uint
+	Content   string    `json:"content"`
+	Tags      string    `json:"tags"`
+	Source    string    `json:"source"`
+	Chunk     int       `json:"chunk"`
+	Embedding []float32 `json:"embedding" gorm:"serializer:json"`
+}
+
+type Reminder struct {
+	gorm.Model
+	MemoryID  uint
+	At        time.Time `json:"at"`
+	Note      string    `json:"note"`
+	Completed bool      `json:"completed"`
+}
+
+// Usage is the token usage of a model call
+type Usage struct {
+	gorm.Model
+	MemoryID         uint
+	Turn             int    `json:"turn"`
+	Purpose          string `json:"purpose" gorm:"index"`
+	ModelName        string `json:"model" gorm:"column:model"`
+	PromptTokens     int    `json:"promptTokens"`
+	CompletionTokens int    `json:"completionTokens"`
+	Estimated        bool   `json:"estimated"`
 }
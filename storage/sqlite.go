@@ -1,55 +1,184 @@
 package storage
 
 import (
+	"encoding/json"
 	"errors"
-	"log"
-
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
 	"github.com/tmc/langchaingo/llms"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 type SqliteStorage struct {
 	DB        *gorm.DB
 	Data      Memory
 	sessionID string
+	path      string
+	logger    *slog.Logger
+
+	// logger without the session, for Session
+	baseLogger *slog.Logger
+}
+
+type SqliteOption func(*SqliteStorage)
+
+// WithLogger logs the database errors and operations, nothing is logged by default.
+func WithLogger(logger *slog.Logger) SqliteOption {
+	return func(storage *SqliteStorage) {
+		storage.logger = logger
+	}
 }
 
-func NewSqliteStorage() SqliteStorage {
-	storage := SqliteStorage{}
-	dbPath := "./storage/memory.db"
+// WithSession reads and writes the memory of the session instead of session-1.
+func WithSession(sessionID string) SqliteOption {
+	return func(storage *SqliteStorage) {
+		storage.sessionID = sessionID
+	}
+}
+
+// WithPath opens the database at the given path instead of ./storage/memory.db.
+func WithPath(path string) SqliteOption {
+	return func(storage *SqliteStorage) {
+		storage.path = path
+	}
+}
 
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+func NewSqliteStorage(opts ...SqliteOption) SqliteStorage {
+	storage := SqliteStorage{
+		path:      "./storage/memory.db",
+		sessionID: "session-1", // tmp hardcoded session id
+		logger:    memory.NopLogger(),
+	}
+
+	for _, opt := range opts {
+		opt(&storage)
+	}
+
+	storage.baseLogger = storage.logger
+	storage.logger = storage.logger.With("session", storage.sessionID)
+
+	// errors are returned and logged by the callers, gorm's
+	// logger would print them to stdout, into the REPL and TUI
+	db, err := gorm.Open(sqlite.Open(storage.path), &gorm.Config{
+		Logger: gormlogger.Discard,
+		// sqlite compares the timestamps as text, they are kept in UTC
+		NowFunc: func() time.Time {
+			return time.Now().UTC()
+		},
+	})
 	if err != nil {
-		log.Printf("Error connecting to DB: %v", err)
+		storage.logger.Error("connecting to database", "path", storage.path, "error", err)
 		return storage
 	}
 
 	sqlDB, err := db.DB()
 	if err != nil {
-		log.Printf("Error getting DB: %v", err)
+		storage.logger.Error("getting database", "path", storage.path, "error", err)
 		return storage
 	}
 
 	sqlDB.Exec("PRAGMA foreign_keys = ON;")
 	sqlDB.Exec("PRAGMA journal_mode = WAL;")
 
-	err = db.AutoMigrate(&Memory{}, &Message{})
+	err = db.AutoMigrate(&Memory{}, &Message{}, &Passage{}, &Reminder{}, &Usage{})
 	if err != nil {
-		log.Printf("Error migrating DB: %v", err)
+		storage.logger.Error("migrating database", "path", storage.path, "error", err)
 		return storage
 	}
 
 	storage.DB = db
-	storage.sessionID = "session-1" // tmp hardcoded session id
 	return storage
 }
 
+// SessionID returns the id of the session the storage reads and writes.
+func (db SqliteStorage) SessionID() string {
+	return db.sessionID
+}
+
+// Session returns a storage for another session on the same database,
+// the session's memory is created when it is first saved.
+func (db SqliteStorage) Session(sessionID string) SqliteStorage {
+	db.sessionID = sessionID
+	db.logger = db.baseLogger.With("session", sessionID)
+
+	return db
+}
+
+// Session describes a session stored in the database
+type Session struct {
+	ID       string
+	Messages int
+
+	// zero when the session has no messages
+	LastMessage time.Time
+}
+
+// Sessions lists the sessions in the database by id.
+func (db SqliteStorage) Sessions() ([]Session, error) {
+	var rows []struct {
+		SessionID   string
+		Messages    int
+		LastMessage string
+	}
+
+	err := db.DB.Model(&Memory{}).
+		Select("memories.session_id, COUNT(messages.id) AS messages, MAX(messages.created_at) AS last_message").
+		Joins("LEFT JOIN messages ON messages.memory_id = memories.id AND messages.deleted_at IS NULL").
+		Group("memories.session_id").
+		Order("memories.session_id").
+		Scan(&rows).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	for _, row := range rows {
+		sessions = append(sessions, Session{
+			ID:          row.SessionID,
+			Messages:    row.Messages,
+			LastMessage: db.parseTimestamp(row.LastMessage),
+		})
+	}
+
+	return sessions, nil
+}
+
+// Export writes the memory of the session as JSON, with its current and
+// archived messages, passages, reminders and usage.
+func (db SqliteStorage) Export(w io.Writer) error {
+	var mem Memory
+
+	err := db.DB.Where("session_id = ?", db.sessionID).
+		Preload("Messages", func(tx *gorm.DB) *gorm.DB { return tx.Order("created_at ASC") }).
+		Preload("Passages").
+		Preload("Reminders").
+		Preload("Usage").
+		First(&mem).Error
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(mem)
+}
+
 func (db SqliteStorage) LoadMessages() ([]llms.MessageContent, error) {
 	var memory Memory
 	err := db.DB.Where("session_id = ?", db.sessionID).First(&memory).Error
 	if err != nil {
-		log.Printf("Error loading messages: %v", err)
+		db.logger.Error("loading messages", "error", err)
 		return []llms.MessageContent{}, err
 	}
 
@@ -59,7 +188,7 @@ func (db SqliteStorage) LoadMessages() ([]llms.MessageContent, error) {
 
 	err = query.Find(&msgs).Error
 	if err != nil {
-		log.Printf("Error loading messages: %v", err)
+		db.logger.Error("loading messages", "error", err)
 		return []llms.MessageContent{}, err
 	}
 
@@ -73,59 +202,55 @@ func (db SqliteStorage) LoadMessages() ([]llms.MessageContent, error) {
 }
 
 func (db SqliteStorage) SaveMessages(messages []llms.MessageContent) error {
-	if len(messages) > 0 {
-		messages = messages[1:]
-	}
-
-	memory := Memory{
+	mem := Memory{
 		SessionID: db.sessionID,
 	}
 
-	err := db.DB.Where("session_id = ?", db.sessionID).FirstOrCreate(&memory).Error
+	err := db.DB.Where("session_id = ?", db.sessionID).FirstOrCreate(&mem).Error
 	if err != nil {
 		return err
 	}
 
+	// only the messages still in short term memory are compared, archived
+	// messages can repeat (e.g. "ok" or identical function calls)
 	var existingMsgs []Message
 
-	err = db.DB.Where("memory_id = ?", memory.ID).Find(&existingMsgs).Error
+	err = db.DB.Where("memory_id = ? AND status = ?", mem.ID, current).Find(&existingMsgs).Error
 	if err != nil {
 		return err
 	}
 
-	existingMsgsSet := make(map[string]struct{})
-
+	// count the saved messages by key so a message repeated
+	// in the queue is saved as many times as it occurs
+	savedMsgs := make(map[string]int)
 	for _, msg := range existingMsgs {
-		existingMsgsSet[msg.Role+msg.Content] = struct{}{}
+		savedMsgs[msg.Role+msg.Content]++
 	}
 
 	newMsgs := []Message{}
 	for _, msg := range messages {
-		var msgContent string
-
-		if msg.Role == llms.ChatMessageTypeTool {
-			msgContent = msg.Parts[0].(llms.ToolCallResponse).Content
-		} else {
-			msgContent = msg.Parts[0].(llms.TextContent).String()
-		}
-
+		msgContent := messageContent(msg)
 		key := string(msg.Role) + msgContent
 
-		if _, ok := existingMsgsSet[key]; !ok {
-			newMsgs = append(newMsgs, Message{
-				Role:     string(msg.Role),
-				Content:  msgContent,
-				MemoryID: memory.ID,
-				Status:   current,
-			})
+		if savedMsgs[key] > 0 {
+			savedMsgs[key]--
+			continue
 		}
+
+		newMsgs = append(newMsgs, Message{
+			Role:     string(msg.Role),
+			Content:  msgContent,
+			MemoryID: mem.ID,
+			Status:   current,
+		})
 	}
 
 	if len(newMsgs) > 0 {
+		db.logger.Debug("saving messages", "messages", len(newMsgs))
 		return db.DB.Save(&newMsgs).Error
 	}
 
-	return errors.New("no new messages to save")
+	return memory.ErrNoNewMessages
 }
 
 func (db SqliteStorage) LoadWorkingContext() (string, error) {
@@ -146,37 +271,96 @@ func (db SqliteStorage) SaveWorkingContext(workingContext string) error {
 	return query.Update("context", workingContext).Error
 }
 
-func (db SqliteStorage) RecallMessages(search string, limit, offset int) (string, error) {
+func (db SqliteStorage) LoadSummary() (string, error) {
 	var memory Memory
+
 	err := db.DB.Where("session_id = ?", db.sessionID).First(&memory).Error
 	if err != nil {
 		return "", err
 	}
 
-	var msgs []Message
+	return memory.Summary, nil
+}
+
+func (db SqliteStorage) SaveSummary(summary string) error {
+	query := db.DB.Model(&Memory{})
+	query.Where("session_id = ?", db.sessionID)
+
+	return query.Update("summary", summary).Error
+}
+
+func (db SqliteStorage) RecallMessages(recall memory.RecallQuery) (memory.RecallResult, error) {
+	sessionID := db.sessionID
+	if recall.Session != "" {
+		sessionID = recall.Session
+	}
 
-	query := db.DB.Where("memory_id = ? AND status = ? AND (role = ? OR role = ?)", memory.ID, archived, "human", "ai")
-	query.Where("content LIKE ?", "%"+search+"%")
+	var mem Memory
+	err := db.DB.Where("session_id = ?", sessionID).First(&mem).Error
+	if err != nil {
+		return memory.RecallResult{}, err
+	}
+
+	roles := []string{"human", "ai"}
+	if len(recall.Roles) > 0 {
+		roles = []string{}
+		for _, role := range recall.Roles {
+			roles = append(roles, string(role))
+		}
+	}
+
+	query := db.DB.Model(&Message{})
+	query.Where("memory_id = ? AND status = ? AND role IN ?", mem.ID, archived, roles)
+
+	if recall.Search != "" {
+		query.Where("content LIKE ?", "%"+recall.Search+"%")
+	}
+
+	if !recall.Start.IsZero() {
+		query.Where("created_at >= ?", recall.Start.UTC())
+	}
+
+	if !recall.End.IsZero() {
+		query.Where("created_at <= ?", recall.End.UTC())
+	}
+
+	// the stored tags are wrapped in commas so a tag only matches whole
+	for _, tag := range memory.NormalizeTags(recall.Tags) {
+		query.Where("(',' || tags || ',') LIKE ? ESCAPE '\\'", "%,"+escapeLike(tag)+",%")
+	}
+
+	var total int64
+	err = query.Count(&total).Error
+	if err != nil {
+		return memory.RecallResult{}, err
+	}
+
+	var msgs []Message
 	query.Order("created_at DESC")
-	query.Limit(limit).Offset(offset)
+	query.Limit(recall.Limit).Offset(recall.Offset)
 
 	err = query.Find(&msgs).Error
 	if err != nil {
-		return "", err
+		return memory.RecallResult{}, err
 	}
 
-	if len(msgs) == 0 {
-		return "", errors.New("no messages found")
+	result := memory.RecallResult{
+		Messages: []memory.RecalledMessage{},
+		Total:    int(total),
 	}
 
-	var results string
 	for _, msg := range msgs {
-		timestamp := msg.CreatedAt.Format("2006-01-02 15:04:05")
-		role := msg.Role
-		results += timestamp + ": " + role + " - " + msg.Content + "\n"
+		result.Messages = append(result.Messages, memory.RecalledMessage{
+			ID:        msg.ID,
+			Role:      llms.ChatMessageType(msg.Role),
+			Content:   msg.Content,
+			Session:   sessionID,
+			Tags:      splitTags(msg.Tags),
+			CreatedAt: msg.CreatedAt,
+		})
 	}
 
-	return results, nil
+	return result, nil
 }
 
 func (db SqliteStorage) ArchiveMessages(messages []llms.MessageContent) error {
@@ -190,22 +374,544 @@ func (db SqliteStorage) ArchiveMessages(messages []llms.MessageContent) error {
 	var existingMsgs []Message
 
 	query := db.DB.Where("memory_id = ? AND status = ?", memory.ID, current)
-	query.Order("created_at DESC")
+	query.Order("created_at ASC")
 
 	err = query.Find(&existingMsgs).Error
 	if err != nil {
 		return err
 	}
 
+	// count the evicted messages by key so duplicated
+	// messages are archived only as many times as they were evicted
+	evictedMsgs := make(map[string]int)
+	for _, msg := range messages {
+		evictedMsgs[string(msg.Role)+messageContent(msg)]++
+	}
+
 	archivedMsgs := []Message{}
-	for _, msg := range existingMsgs[:len(existingMsgs)-3] {
-		msg.Status = archived
-		archivedMsgs = append(archivedMsgs, msg)
+	for _, msg := range existingMsgs {
+		key := msg.Role + msg.Content
+		if evictedMsgs[key] > 0 {
+			evictedMsgs[key]--
+			msg.Status = archived
+			archivedMsgs = append(archivedMsgs, msg)
+		}
+	}
+
+	if len(archivedMsgs) == 0 {
+		return errors.New("no new messages to archive")
+	}
+
+	db.logger.Debug("archiving messages", "messages", len(archivedMsgs))
+
+	err = db.DB.Save(&archivedMsgs).Error
+	if err != nil {
+		return err
+	}
+
+	return db.DB.Model(&memory).Update("evicted_at", time.Now()).Error
+}
+
+func (db SqliteStorage) LoadUnconsolidatedMessages(limit int) ([]memory.RecalledMessage, error) {
+	var mem Memory
+	err := db.DB.Where("session_id = ?", db.sessionID).First(&mem).Error
+	if err != nil {
+		return []memory.RecalledMessage{}, err
+	}
+
+	var msgs []Message
+	query := db.DB.Where("memory_id = ? AND status = ? AND consolidated = ?", mem.ID, archived, false)
+	query.Order("created_at ASC")
+	query.Limit(limit)
+
+	err = query.Find(&msgs).Error
+	if err != nil {
+		return []memory.RecalledMessage{}, err
+	}
+
+	results := []memory.RecalledMessage{}
+	for _, msg := range msgs {
+		results = append(results, memory.RecalledMessage{
+			ID:        msg.ID,
+			Role:      llms.ChatMessageType(msg.Role),
+			Content:   msg.Content,
+			Session:   db.sessionID,
+			Tags:      splitTags(msg.Tags),
+			CreatedAt: msg.CreatedAt,
+		})
+	}
+
+	return results, nil
+}
+
+func (db SqliteStorage) ConsolidateMessages(ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return db.DB.Model(&Message{}).Where("id IN ?", ids).Update("consolidated", true).Error
+}
+
+func (db SqliteStorage) MessageStats() (memory.MessageStats, error) {
+	var mem Memory
+	err := db.DB.Where("session_id = ?", db.sessionID).First(&mem).Error
+	if err != nil {
+		return memory.MessageStats{}, err
+	}
+
+	var row struct {
+		Count  int
+		Oldest string
+		Newest string
+	}
+
+	err = db.DB.Model(&Message{}).
+		Select("COUNT(*) AS count, MIN(created_at) AS oldest, MAX(created_at) AS newest").
+		Where("memory_id = ? AND status = ?", mem.ID, archived).
+		Scan(&row).Error
+
+	if err != nil {
+		return memory.MessageStats{}, err
+	}
+
+	return memory.MessageStats{
+		Archived:     row.Count,
+		Oldest:       db.parseTimestamp(row.Oldest),
+		Newest:       db.parseTimestamp(row.Newest),
+		LastEviction: mem.EvictedAt,
+	}, nil
+}
+
+func (db SqliteStorage) SaveUsage(usage memory.Usage) error {
+	mem := Memory{
+		SessionID: db.sessionID,
+	}
+
+	err := db.DB.Where("session_id = ?", db.sessionID).FirstOrCreate(&mem).Error
+	if err != nil {
+		return err
+	}
+
+	record := Usage{
+		MemoryID:         mem.ID,
+		Turn:             usage.Turn,
+		Purpose:          string(usage.Purpose),
+		ModelName:        usage.Model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Estimated:        usage.Estimated,
+	}
+
+	// sqlite compares the timestamps as text, they are kept in UTC
+	record.CreatedAt = time.Now().UTC()
+	if !usage.CreatedAt.IsZero() {
+		record.CreatedAt = usage.CreatedAt.UTC()
+	}
+
+	return db.DB.Create(&record).Error
+}
+
+// LoadUsage totals the usage by session, purpose and model
+func (db SqliteStorage) LoadUsage(query memory.UsageQuery) ([]memory.UsageTotal, error) {
+	var rows []struct {
+		SessionID        string
+		Purpose          string
+		Model            string
+		Calls            int
+		PromptTokens     int
+		CompletionTokens int
+		Estimated        int
+	}
+
+	sql := db.DB.Model(&Usage{}).
+		Select("memories.session_id, usages.purpose, usages.model, COUNT(*) AS calls, " +
+			"SUM(usages.prompt_tokens) AS prompt_tokens, SUM(usages.completion_tokens) AS completion_tokens, " +
+			"SUM(CASE WHEN usages.estimated THEN 1 ELSE 0 END) AS estimated").
+		Joins("JOIN memories ON memories.id = usages.memory_id")
+
+	if !query.AllSessions {
+		sessionID := db.sessionID
+		if query.Session != "" {
+			sessionID = query.Session
+		}
+
+		sql = sql.Where("memories.session_id = ?", sessionID)
+	}
+
+	if !query.Since.IsZero() {
+		sql = sql.Where("usages.created_at >= ?", query.Since.UTC())
+	}
+
+	if query.Purpose != "" {
+		sql = sql.Where("usages.purpose = ?", string(query.Purpose))
+	}
+
+	if query.Model != "" {
+		sql = sql.Where("usages.model = ?", query.Model)
+	}
+
+	err := sql.Group("memories.session_id, usages.purpose, usages.model").
+		Order("memories.session_id, usages.purpose, usages.model").
+		Scan(&rows).Error
+
+	if err != nil {
+		return []memory.UsageTotal{}, err
+	}
+
+	totals := []memory.UsageTotal{}
+	for _, row := range rows {
+		totals = append(totals, memory.UsageTotal{
+			Session:          row.SessionID,
+			Purpose:          memory.UsagePurpose(row.Purpose),
+			Model:            row.Model,
+			Calls:            row.Calls,
+			PromptTokens:     row.PromptTokens,
+			CompletionTokens: row.CompletionTokens,
+			Estimated:        row.Estimated,
+		})
+	}
+
+	return totals, nil
+}
+
+func (db SqliteStorage) PassageStats() (memory.PassageStats, error) {
+	var mem Memory
+	err := db.DB.Where("session_id = ?", db.sessionID).First(&mem).Error
+	if err != nil {
+		return memory.PassageStats{}, err
+	}
+
+	var row struct {
+		Count  int
+		Oldest string
+		Newest string
+	}
+
+	err = db.DB.Model(&Passage{}).
+		Select("COUNT(*) AS count, MIN(created_at) AS oldest, MAX(created_at) AS newest").
+		Where("memory_id = ?", mem.ID).
+		Scan(&row).Error
+
+	if err != nil {
+		return memory.PassageStats{}, err
+	}
+
+	return memory.PassageStats{
+		Passages: row.Count,
+		Oldest:   db.parseTimestamp(row.Oldest),
+		Newest:   db.parseTimestamp(row.Newest),
+	}, nil
+}
+
+func (db SqliteStorage) LoadPinnedMessages() ([]llms.MessageContent, error) {
+	var memory Memory
+	err := db.DB.Where("session_id = ?", db.sessionID).First(&memory).Error
+	if err != nil {
+		return []llms.MessageContent{}, err
+	}
+
+	var msgs []Message
+	query := db.DB.Where("memory_id = ? AND status = ? AND pinned = ?", memory.ID, current, true)
+	query.Order("created_at ASC")
+
+	err = query.Find(&msgs).Error
+	if err != nil {
+		return []llms.MessageContent{}, err
+	}
+
+	result := []llms.MessageContent{}
+	for _, message := range msgs {
+		result = append(result, llms.TextParts(llms.ChatMessageType(message.Role), message.Content))
+	}
+
+	return result, nil
+}
+
+func (db SqliteStorage) PinMessage(message llms.MessageContent, pinned bool) error {
+	memory := Memory{
+		SessionID: db.sessionID,
+	}
+
+	err := db.DB.Where("session_id = ?", db.sessionID).FirstOrCreate(&memory).Error
+	if err != nil {
+		return err
+	}
+
+	// messages can be pinned before they are saved,
+	// in that case the message is saved together with the pin
+	msg := Message{
+		Role:     string(message.Role),
+		Content:  messageContent(message),
+		MemoryID: memory.ID,
+		Status:   current,
+	}
+
+	query := db.DB.Where("memory_id = ? AND status = ? AND role = ? AND content = ?", memory.ID, current, msg.Role, msg.Content)
+	query.Order("created_at DESC")
+
+	err = query.FirstOrCreate(&msg).Error
+	if err != nil {
+		return err
+	}
+
+	return db.DB.Model(&msg).Update("pinned", pinned).Error
+}
+
+// TagMessage adds the tags to the most recent current message with
+// the same role and content, the message is saved if it wasn't yet.
+func (db SqliteStorage) TagMessage(message llms.MessageContent, tags []string) error {
+	mem := Memory{
+		SessionID: db.sessionID,
+	}
+
+	err := db.DB.Where("session_id = ?", db.sessionID).FirstOrCreate(&mem).Error
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		Role:     string(message.Role),
+		Content:  messageContent(message),
+		MemoryID: mem.ID,
+		Status:   current,
+	}
+
+	query := db.DB.Where("memory_id = ? AND status = ? AND role = ? AND content = ?", mem.ID, current, msg.Role, msg.Content)
+	query.Order("created_at DESC")
+
+	err = query.FirstOrCreate(&msg).Error
+	if err != nil {
+		return err
+	}
+
+	merged := memory.NormalizeTags(append(splitTags(msg.Tags), tags...))
+
+	return db.DB.Model(&msg).Update("tags", strings.Join(merged, ",")).Error
+}
+
+func (db SqliteStorage) InsertPassages(passages []memory.Passage) error {
+	mem := Memory{
+		SessionID: db.sessionID,
+	}
+
+	err := db.DB.Where("session_id = ?", db.sessionID).FirstOrCreate(&mem).Error
+	if err != nil {
+		return err
+	}
+
+	newPassages := []Passage{}
+	for _, passage := range passages {
+		newPassages = append(newPassages, Passage{
+			MemoryID:  mem.ID,
+			Content:   passage.Content,
+			Tags:      strings.Join(passage.Tags, ","),
+			Source:    passage.Source,
+			Chunk:     passage.Chunk,
+			Embedding: passage.Embedding,
+		})
+	}
+
+	if len(newPassages) > 0 {
+		return db.DB.CreateInBatches(&newPassages, 100).Error
+	}
+
+	return errors.New("no passages to insert")
+}
+
+func (db SqliteStorage) SearchPassages(search memory.PassageQuery) ([]memory.Passage, int, error) {
+	var mem Memory
+	err := db.DB.Where("session_id = ?", db.sessionID).First(&mem).Error
+	if err != nil {
+		return []memory.Passage{}, 0, err
+	}
+
+	if len(search.Embedding) > 0 {
+		return db.searchPassagesBySimilarity(mem, search)
+	}
+
+	query := db.DB.Model(&Passage{})
+	query.Where("memory_id = ?", mem.ID)
+	query.Where("content LIKE ? OR tags LIKE ?", "%"+search.Search+"%", "%"+search.Search+"%")
+
+	var total int64
+	err = query.Count(&total).Error
+	if err != nil {
+		return []memory.Passage{}, 0, err
+	}
+
+	var passages []Passage
+	query.Order("created_at DESC")
+	query.Limit(search.Limit).Offset(search.Offset)
+
+	err = query.Find(&passages).Error
+	if err != nil {
+		return []memory.Passage{}, 0, err
+	}
+
+	results := []memory.Passage{}
+	for _, passage := range passages {
+		results = append(results, toMemoryPassage(passage))
+	}
+
+	return results, int(total), nil
+}
+
+// searchPassagesBySimilarity ranks the embedded passages by cosine
+// similarity to the query embedding, sqlite has no vector index so
+// the ranking is done in memory
+func (db SqliteStorage) searchPassagesBySimilarity(mem Memory, search memory.PassageQuery) ([]memory.Passage, int, error) {
+	var passages []Passage
+
+	err := db.DB.Where("memory_id = ? AND embedding IS NOT NULL", mem.ID).Find(&passages).Error
+	if err != nil {
+		return []memory.Passage{}, 0, err
+	}
+
+	scores := make(map[uint]float32, len(passages))
+	for _, passage := range passages {
+		scores[passage.ID] = cosineSimilarity(search.Embedding, passage.Embedding)
+	}
+
+	sort.SliceStable(passages, func(i, j int) bool {
+		return scores[passages[i].ID] > scores[passages[j].ID]
+	})
+
+	results := []memory.Passage{}
+	for i := search.Offset; i < len(passages) && i < search.Offset+search.Limit; i++ {
+		results = append(results, toMemoryPassage(passages[i]))
+	}
+
+	return results, len(passages), nil
+}
+
+func toMemoryPassage(passage Passage) memory.Passage {
+	return memory.Passage{
+		Content:   passage.Content,
+		Tags:      splitTags(passage.Tags),
+		CreatedAt: passage.CreatedAt,
+		Source:    passage.Source,
+		Chunk:     passage.Chunk,
+	}
+}
+
+func cosineSimilarity(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return float32(dot / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
+
+func (db SqliteStorage) LoadReminders() ([]memory.Reminder, error) {
+	var mem Memory
+	err := db.DB.Where("session_id = ?", db.sessionID).First(&mem).Error
+	if err != nil {
+		return []memory.Reminder{}, err
+	}
+
+	var reminders []Reminder
+	query := db.DB.Where("memory_id = ? AND completed = ?", mem.ID, false)
+	query.Order("at ASC")
+
+	err = query.Find(&reminders).Error
+	if err != nil {
+		return []memory.Reminder{}, err
+	}
+
+	results := []memory.Reminder{}
+	for _, reminder := range reminders {
+		results = append(results, memory.Reminder{
+			ID:   reminder.ID,
+			At:   reminder.At,
+			Note: reminder.Note,
+		})
+	}
+
+	return results, nil
+}
+
+func (db SqliteStorage) SaveReminder(reminder memory.Reminder) (memory.Reminder, error) {
+	mem := Memory{
+		SessionID: db.sessionID,
+	}
+
+	err := db.DB.Where("session_id = ?", db.sessionID).FirstOrCreate(&mem).Error
+	if err != nil {
+		return memory.Reminder{}, err
+	}
+
+	newReminder := Reminder{
+		MemoryID: mem.ID,
+		At:       reminder.At,
+		Note:     reminder.Note,
+	}
+
+	err = db.DB.Create(&newReminder).Error
+	if err != nil {
+		return memory.Reminder{}, err
+	}
+
+	reminder.ID = newReminder.ID
+
+	return reminder, nil
+}
+
+func (db SqliteStorage) CompleteReminder(id uint) error {
+	return db.DB.Model(&Reminder{}).Where("id = ?", id).Update("completed", true).Error
+}
+
+// parseTimestamp parses the timestamps returned by sqlite aggregates,
+// which come back as text instead of time values
+func (db SqliteStorage) parseTimestamp(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+
+	db.logger.Error("parsing timestamp", "value", value)
+	return time.Time{}
+}
+
+// escapeLike escapes the LIKE wildcards, the query sets \ as the escape character
+func escapeLike(text string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(text)
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+
+	return strings.Split(tags, ",")
+}
+
+func messageContent(msg llms.MessageContent) string {
+	if len(msg.Parts) == 0 {
+		return ""
 	}
 
-	if len(archivedMsgs) > 0 {
-		return db.DB.Save(&archivedMsgs).Error
+	switch part := msg.Parts[0].(type) {
+	case llms.ToolCallResponse:
+		return part.Content
+	case llms.TextContent:
+		return part.String()
 	}
 
-	return errors.New("no new messages to archive")
+	return ""
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// setupTracing exports spans over OTLP/HTTP when an OTLP endpoint is configured,
+// the exporter reads the standard OTEL_EXPORTER_OTLP_* variables (endpoint,
+// headers, timeout) and OTEL_SERVICE_NAME overrides the service name.
+// The returned function flushes the pending spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// later detectors win, OTEL_SERVICE_NAME overrides the default name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "gomemgpt")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
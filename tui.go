@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
+	"github.com/Struki84/GoMemGPT/storage"
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// function calls kept in the stream pane
+const maxFunctionCalls = 100
+
+var (
+	paneStyle  = lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).BorderForeground(lipgloss.Color("8"))
+	titleStyle = lipgloss.NewStyle().Bold(true)
+	userStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("12"))
+	agentStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
+	dimStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	errorStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+
+	// gauge colors by pressure level
+	pressureColors = map[memory.PressureLevel]lipgloss.Color{
+		memory.PressureNone:     lipgloss.Color("10"),
+		memory.PressureNotice:   lipgloss.Color("11"),
+		memory.PressureWarn:     lipgloss.Color("208"),
+		memory.PressureCritical: lipgloss.Color("9"),
+		memory.PressureFull:     lipgloss.Color("9"),
+	}
+)
+
+// inspect runs the chat in a full screen memory inspector, usage: go run . tui
+func inspect(ctx context.Context, sessionStorage storage.SqliteStorage, newAgent func(context.Context, storage.SqliteStorage, ...AgentOption) (Agent, error)) {
+	calls := make(chan memory.FunctionCall, maxFunctionCalls)
+
+	agent, err := newAgent(ctx, sessionStorage, WithProcessorOptions(memory.WithFunctionCalls(func(call memory.FunctionCall) {
+		// the processor doesn't wait for the screen
+		select {
+		case calls <- call:
+		default:
+		}
+	})))
+
+	if err != nil {
+		log.Fatalf("Error initializing agent: %v", err)
+	}
+
+	_, err = tea.NewProgram(newInspector(agent, sessionStorage.SessionID(), calls), tea.WithAltScreen(), tea.WithContext(ctx)).Run()
+	if err != nil {
+		log.Fatalf("Error running inspector: %v", err)
+	}
+}
+
+type (
+	replyMsg        string
+	turnDoneMsg     struct{}
+	notificationMsg string
+	functionCallMsg memory.FunctionCall
+	snapshotMsg     Snapshot
+	tickMsg         time.Time
+)
+
+// inspector shows the chat next to the agent's memory, the memory is read
+// with snapshots after every reply and function call, and once a second
+type inspector struct {
+	agent   Agent
+	session string
+	calls   <-chan memory.FunctionCall
+	replies chan tea.Msg
+
+	chat       viewport.Model
+	input      textinput.Model
+	transcript []string
+	waiting    bool
+
+	snapshot      Snapshot
+	refreshing    bool
+	functionCalls []memory.FunctionCall
+
+	width  int
+	height int
+}
+
+func newInspector(agent Agent, session string, calls <-chan memory.FunctionCall) *inspector {
+	input := textinput.New()
+	input.Placeholder = "Type a message, esc to quit"
+	input.Prompt = "> "
+	input.Focus()
+
+	return &inspector{
+		agent:   agent,
+		session: session,
+		calls:   calls,
+		replies: make(chan tea.Msg, 10),
+		chat:    viewport.New(0, 0),
+		input:   input,
+	}
+}
+
+func (m *inspector) Init() tea.Cmd {
+	return tea.Batch(textinput.Blink, m.waitForCall(), m.waitForReply(), m.waitForNotification(), m.refresh(), tick())
+}
+
+func (m *inspector) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.layout()
+		return m, nil
+	case tea.KeyMsg:
+		switch msg.Type {
+		case tea.KeyCtrlC, tea.KeyEsc:
+			return m, tea.Quit
+		case tea.KeyEnter:
+			return m, m.send()
+		case tea.KeyPgUp, tea.KeyPgDown:
+			var cmd tea.Cmd
+			m.chat, cmd = m.chat.Update(msg)
+			return m, cmd
+		}
+	case replyMsg:
+		m.say(agentStyle.Render("Agent: ") + string(msg))
+		return m, tea.Batch(m.waitForReply(), m.refresh())
+	case turnDoneMsg:
+		m.waiting = false
+		return m, tea.Batch(m.waitForReply(), m.refresh())
+	case notificationMsg:
+		m.say(agentStyle.Render("Agent: ") + string(msg))
+		return m, tea.Batch(m.waitForNotification(), m.refresh())
+	case functionCallMsg:
+		m.functionCalls = append(m.functionCalls, memory.FunctionCall(msg))
+		if len(m.functionCalls) > maxFunctionCalls {
+			m.functionCalls = m.functionCalls[1:]
+		}
+
+		return m, tea.Batch(m.waitForCall(), m.refresh())
+	case snapshotMsg:
+		m.snapshot = Snapshot(msg)
+		m.refreshing = false
+		return m, nil
+	case tickMsg:
+		return m, tea.Batch(m.refresh(), tick())
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+
+	return m, cmd
+}
+
+// send passes the input to the agent, the replies arrive as replyMsgs
+// followed by a turnDoneMsg once the agent is done with the message
+func (m *inspector) send() tea.Cmd {
+	// one turn at a time, the input is kept until the reply is in
+	if m.waiting {
+		return nil
+	}
+
+	input := strings.TrimSpace(m.input.Value())
+	if input == "" {
+		return nil
+	}
+
+	m.input.Reset()
+	m.waiting = true
+	m.say(userStyle.Render("You: ") + input)
+
+	return func() tea.Msg {
+		done := m.agent.Call(input, func(msg string) {
+			m.replies <- replyMsg(msg)
+		})
+
+		<-done
+		m.replies <- turnDoneMsg{}
+
+		return nil
+	}
+}
+
+func (m *inspector) say(line string) {
+	m.transcript = append(m.transcript, line)
+	m.renderChat()
+}
+
+func (m *inspector) waitForReply() tea.Cmd {
+	return func() tea.Msg {
+		return <-m.replies
+	}
+}
+
+// waitForNotification waits for what the agent says on its own, e.g. on a reminder
+func (m *inspector) waitForNotification() tea.Cmd {
+	notifications := m.agent.Notifications()
+
+	return func() tea.Msg {
+		return notificationMsg(<-notifications)
+	}
+}
+
+func (m *inspector) waitForCall() tea.Cmd {
+	return func() tea.Msg {
+		return functionCallMsg(<-m.calls)
+	}
+}
+
+// refresh reads a snapshot, it waits for the processor to finish
+// the message it is handling so only one is read at a time
+func (m *inspector) refresh() tea.Cmd {
+	if m.refreshing {
+		return nil
+	}
+
+	m.refreshing = true
+	agent := m.agent
+
+	return func() tea.Msg {
+		return snapshotMsg(agent.Snapshot())
+	}
+}
+
+func tick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+		return tickMsg(t)
+	})
+}
+
+// the chat takes the left 3/5 of the screen
+func (m *inspector) chatWidth() int {
+	return m.width * 3 / 5
+}
+
+func (m *inspector) layout() {
+	// border, title and input lines
+	m.chat.Width = max(m.chatWidth()-2, 0)
+	m.chat.Height = max(m.height-4, 0)
+	m.input.Width = max(m.chatWidth()-5, 0)
+	m.renderChat()
+}
+
+func (m *inspector) renderChat() {
+	wrap := lipgloss.NewStyle().Width(m.chat.Width)
+
+	lines := []string{}
+	for _, line := range m.transcript {
+		lines = append(lines, wrap.Render(line))
+	}
+
+	m.chat.SetContent(strings.Join(lines, "\n"))
+	m.chat.GotoBottom()
+}
+
+func (m *inspector) View() string {
+	if m.width == 0 {
+		return ""
+	}
+
+	title := "Chat, session " + m.session
+	if m.waiting {
+		title += dimStyle.Render("  thinking...")
+	}
+
+	chat := pane(title, m.chat.View()+"\n"+m.input.View(), m.chatWidth(), m.height)
+
+	width := m.width - m.chatWidth()
+	gauges := 7
+	workingContext := (m.height - gauges) / 3
+	messages := (m.height - gauges - workingContext) / 2
+	calls := m.height - gauges - workingContext - messages
+
+	side := lipgloss.JoinVertical(lipgloss.Left,
+		pane("Working context", m.workingContextView(width), width, workingContext),
+		pane(m.messagesTitle(), m.messagesView(width, messages-3), width, messages),
+		pane("Memory pressure", m.pressureView(width), width, gauges),
+		pane("Function calls", m.functionCallsView(width, calls-3), width, calls),
+	)
+
+	return lipgloss.JoinHorizontal(lipgloss.Top, chat, side)
+}
+
+func (m *inspector) workingContextView(width int) string {
+	if strings.TrimSpace(m.snapshot.WorkingContext) == "" {
+		return dimStyle.Render("empty")
+	}
+
+	return lipgloss.NewStyle().Width(width - 2).Render(m.snapshot.WorkingContext)
+}
+
+func (m *inspector) messagesTitle() string {
+	tokens := 0
+	for _, msg := range m.snapshot.Messages {
+		tokens += msg.Tokens
+	}
+
+	return fmt.Sprintf("Messages (%d, %d tokens)", len(m.snapshot.Messages), tokens)
+}
+
+// messagesView lists the newest messages that fit with their tokens
+func (m *inspector) messagesView(width int, height int) string {
+	msgs := m.snapshot.Messages
+	if height > 0 && len(msgs) > height {
+		msgs = msgs[len(msgs)-height:]
+	}
+
+	lines := []string{}
+	for _, msg := range msgs {
+		pin := " "
+		if msg.Pinned {
+			pin = "*"
+		}
+
+		line := fmt.Sprintf("%s%-6s %5d  ", pin, msg.Role, msg.Tokens)
+		lines = append(lines, line+preview(msg.Text, width-5-len(line)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (m *inspector) pressureView(width int) string {
+	stats := m.snapshot.Stats
+
+	return strings.Join([]string{
+		gauge("Working context", stats.WorkingContext, width-2),
+		gauge("Messages", stats.Queue, width-2),
+		gauge("Summary", stats.Summary, width-2),
+		gauge("Pinned", stats.Pinned, width-2),
+	}, "\n")
+}
+
+// functionCallsView shows the newest function calls that fit
+func (m *inspector) functionCallsView(width int, height int) string {
+	calls := m.functionCalls
+	if height > 0 && len(calls) > height {
+		calls = calls[len(calls)-height:]
+	}
+
+	lines := []string{}
+	for _, call := range calls {
+		result := call.Result
+		style := lipgloss.NewStyle()
+		if call.Err != nil {
+			result = call.Err.Error()
+			style = errorStyle
+		}
+
+		line := fmt.Sprintf("%d.%d %s(%s) -> %s", call.Turn, call.Step, call.Name, call.Arguments, result)
+		lines = append(lines, style.Render(preview(line, width-5)))
+	}
+
+	if len(lines) == 0 {
+		return dimStyle.Render("no function calls yet")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// gauge renders the usage of a section as a bar colored by its pressure level
+func gauge(label string, usage memory.SectionUsage, width int) string {
+	text := fmt.Sprintf(" %d/%d", usage.Tokens, usage.Budget)
+	size := max(width-16-len(text), 0)
+
+	filled := 0
+	if usage.Budget > 0 {
+		filled = min(usage.Tokens*size/usage.Budget, size)
+	}
+
+	bar := lipgloss.NewStyle().Foreground(pressureColors[usage.Level()]).Render(strings.Repeat("█", filled)) +
+		dimStyle.Render(strings.Repeat("░", size-filled))
+
+	return fmt.Sprintf("%-16s%s%s", label, bar, text)
+}
+
+// pane renders the body in a bordered box of the given outer size,
+// lines that don't fit are cut off
+func pane(title string, body string, width int, height int) string {
+	lines := strings.Split(body, "\n")
+	if inner := height - 3; len(lines) > inner {
+		lines = lines[:max(inner, 0)]
+	}
+
+	content := titleStyle.Render(title) + "\n" + strings.Join(lines, "\n")
+
+	return paneStyle.
+		Width(max(width-2, 0)).
+		Height(max(height-2, 0)).
+		MaxHeight(max(height, 0)).
+		Render(content)
+}
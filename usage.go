@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Struki84/GoMemGPT/memory"
+)
+
+// usage prints the token usage and cost estimates, usage:
+// go run . usage [-since 24h] [-session id] [-all]
+func usage(storage memory.MemoryStorage, args []string) {
+	flags := flag.NewFlagSet("usage", flag.ExitOnError)
+	since := flags.Duration("since", 0, "only total the usage of the last period, e.g. 24h")
+	session := flags.String("session", "", "session to total, defaults to the current session")
+	all := flags.Bool("all", false, "total the usage of all sessions")
+	flags.Parse(args)
+
+	query := memory.UsageQuery{
+		Session:     *session,
+		AllSessions: *all,
+	}
+
+	if *since > 0 {
+		query.Since = time.Now().Add(-*since)
+	}
+
+	report, err := memory.LoadUsageReport(storage, query, memory.DefaultPricing)
+	if err != nil {
+		log.Fatalf("Error loading usage: %v", err)
+	}
+
+	if len(report.Totals) == 0 {
+		fmt.Println("No usage recorded")
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "SESSION\tPURPOSE\tMODEL\tCALLS\tPROMPT\tCOMPLETION\tCOST\t")
+
+	estimated := 0
+	for _, total := range report.Totals {
+		model := total.Model
+		if model == "" {
+			model = "-"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\t%d\t$%.4f\t\n",
+			total.Session, total.Purpose, model, total.Calls, total.PromptTokens, total.CompletionTokens, total.Cost)
+
+		estimated += total.Estimated
+	}
+
+	promptTokens, completionTokens := report.Tokens()
+	fmt.Fprintf(writer, "TOTAL\t\t\t\t%d\t%d\t$%.4f\t\n", promptTokens, completionTokens, report.Cost)
+	writer.Flush()
+
+	if estimated > 0 {
+		fmt.Printf("\n%d calls were counted locally, their provider didn't report usage\n", estimated)
+	}
+
+	if len(report.Unpriced) > 0 {
+		fmt.Printf("No price for %v, their cost is not included\n", report.Unpriced)
+	}
+}